@@ -0,0 +1,80 @@
+package auth
+
+import (
+	"github.com/RealFax/peregrine"
+	"github.com/gobwas/ws"
+	"github.com/pkg/errors"
+	"net/http"
+)
+
+const (
+	KeyPrincipal = "peregrine_auth_principal"
+)
+
+var (
+	ErrNoToken = errors.New("no token")
+)
+
+// Principal the identity authenticated by the token
+type Principal struct {
+	Subject string
+	Claims  map[string]any
+}
+
+// Authenticator verify the token, returns the principal of token
+type Authenticator interface {
+	Authenticate(token string) (*Principal, error)
+}
+
+// AuthenticatorFunc is an adapter to allow the use of ordinary functions as Authenticator
+type AuthenticatorFunc func(token string) (*Principal, error)
+
+func (f AuthenticatorFunc) Authenticate(token string) (*Principal, error) {
+	return f(token)
+}
+
+// WithAuthenticator authenticate the handshake by the token read by extractors (the first found is used),
+// the principal is attached to the conn and can be read by PrincipalOf.
+//
+// the handshake without valid token is rejected with 401
+func WithAuthenticator(authenticator Authenticator, extractors ...Extractor) peregrine.OptionFunc {
+	if len(extractors) == 0 {
+		extractors = []Extractor{FromHeader("Authorization", "Bearer")}
+	}
+	return func(s *peregrine.Server) {
+		s.UseOnHandshakeHandler(Handshake(authenticator, extractors...))
+	}
+}
+
+// Handshake returns the OnHandshakeHandlerFunc authenticate the handshake, see WithAuthenticator
+func Handshake(authenticator Authenticator, extractors ...Extractor) peregrine.OnHandshakeHandlerFunc {
+	return func(conn *peregrine.Conn, r *http.Request) error {
+		token, err := extract(r, extractors)
+		if err == nil {
+			var principal *Principal
+			if principal, err = authenticator.Authenticate(token); err == nil {
+				conn.Set(KeyPrincipal, principal)
+				return nil
+			}
+		}
+		return ws.RejectConnectionError(
+			ws.RejectionStatus(http.StatusUnauthorized),
+			ws.RejectionReason(err.Error()),
+			ws.RejectionHeader(ws.HandshakeHeaderString("WWW-Authenticate: Bearer\r\n")),
+		)
+	}
+}
+
+// PrincipalOf returns the principal attached to conn by the authenticator
+func PrincipalOf(conn *peregrine.Conn) (*Principal, bool) {
+	return peregrine.TryAssertKeys[*Principal](conn, KeyPrincipal)
+}
+
+func extract(r *http.Request, extractors []Extractor) (string, error) {
+	for _, extractor := range extractors {
+		if token, ok := extractor(r); ok && token != "" {
+			return token, nil
+		}
+	}
+	return "", ErrNoToken
+}
@@ -0,0 +1,142 @@
+package auth_test
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"github.com/RealFax/peregrine"
+	"github.com/RealFax/peregrine/auth"
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/panjf2000/gnet/v2"
+	"net/http"
+	"testing"
+	"time"
+)
+
+const authAddr = "127.0.0.1:19511"
+
+func hs256Token(secret []byte, payload string) string {
+	signed := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." +
+		base64.RawURLEncoding.EncodeToString([]byte(payload))
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestWithAuthenticator(t *testing.T) {
+	secret := []byte("peregrine")
+	whoami := func(packet *peregrine.Packet) {
+		principal, _ := auth.PrincipalOf(packet.Conn)
+		_ = packet.Conn.WriteText([]byte(principal.Subject))
+	}
+
+	server := peregrine.NewServer(
+		"tcp://"+authAddr,
+		auth.WithAuthenticator(
+			auth.NewJWTVerifier(auth.WithHMACKey(secret)),
+			auth.FromHeader("Authorization", "Bearer"),
+			auth.FromQuery("token"),
+			auth.FromCookie("token"),
+			auth.FromSubprotocol("access_token."),
+		),
+		peregrine.WithHandler(whoami),
+		// the companion subprotocol of token
+		peregrine.WithSubprotocols(map[string]peregrine.HandlerFunc{"chat": whoami}),
+	)
+
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- server.ListenAndServe(gnet.WithReuseAddr(true))
+	}()
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_ = server.Shutdown(ctx)
+		<-stopped
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	var (
+		token   = hs256Token(secret, `{"sub":"user-1"}`)
+		forged  = hs256Token([]byte("forged"), `{"sub":"user-1"}`)
+		headers = func(key, value string) ws.HandshakeHeader {
+			return ws.HandshakeHeaderHTTP(http.Header{key: []string{value}})
+		}
+	)
+
+	tests := []struct {
+		name      string
+		uri       string
+		header    ws.HandshakeHeader
+		protocols []string
+		status    int
+	}{
+		{name: "header", header: headers("Authorization", "Bearer "+token)},
+		{name: "query", uri: "/?token=" + token},
+		{name: "cookie", header: headers("Cookie", "token="+token)},
+		{name: "subprotocol", protocols: []string{"chat", "access_token." + token}},
+		{name: "no token", status: http.StatusUnauthorized},
+		{name: "forged token", header: headers("Authorization", "Bearer "+forged), status: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		dialer := ws.Dialer{Header: tt.header, Protocols: tt.protocols}
+		conn, _, hs, err := dialer.Dial(context.Background(), "ws://"+authAddr+tt.uri)
+		if tt.status != 0 {
+			if err != ws.StatusError(tt.status) {
+				t.Fatalf("%s: expect status %d, got: %v", tt.name, tt.status, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if tt.protocols != nil && hs.Protocol != "chat" {
+			t.Fatalf("companion subprotocol not selected: %q", hs.Protocol)
+		}
+
+		_ = conn.SetDeadline(time.Now().Add(time.Second))
+		if err = wsutil.WriteClientText(conn, []byte("whoami")); err != nil {
+			t.Fatal(err)
+		}
+		if msg, rerr := wsutil.ReadServerText(conn); rerr != nil || string(msg) != "user-1" {
+			t.Fatalf("%s: unexpected principal: %s, %v", tt.name, msg, rerr)
+		}
+		_ = conn.Close()
+	}
+}
+
+func TestWithAuthenticator_HandshakeHandler(t *testing.T) {
+	var (
+		authenticator = auth.WithAuthenticator(auth.NewJWTVerifier(auth.WithHMACKey([]byte("peregrine"))))
+		handshake     = peregrine.WithOnHandshakeHandler(func(*peregrine.Conn, *http.Request) error { return nil })
+	)
+
+	// the authenticator is never replaced by the handshake handler, whatever the order of options
+	for i, opts := range [][]peregrine.OptionFunc{
+		{authenticator, handshake},
+		{handshake, authenticator},
+	} {
+		addr := fmt.Sprintf("127.0.0.1:%d", 19512+i)
+		server := peregrine.NewServer("tcp://"+addr, opts...)
+
+		stopped := make(chan error, 1)
+		go func() {
+			stopped <- server.ListenAndServe(gnet.WithReuseAddr(true))
+		}()
+		time.Sleep(200 * time.Millisecond)
+
+		_, _, _, err := ws.Dial(context.Background(), "ws://"+addr)
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		_ = server.Shutdown(ctx)
+		cancel()
+		<-stopped
+
+		if err != ws.StatusError(http.StatusUnauthorized) {
+			t.Fatalf("options %d: expect status 401, got: %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package auth
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Extractor read the token from the handshake request, returns false if not found
+type Extractor func(r *http.Request) (string, bool)
+
+// FromHeader read the token from header, the scheme (e.g. "Bearer") is trimmed if it's not empty
+func FromHeader(name, scheme string) Extractor {
+	return func(r *http.Request) (string, bool) {
+		value := r.Header.Get(name)
+		if value == "" {
+			return "", false
+		}
+		if scheme == "" {
+			return value, true
+		}
+		if len(value) <= len(scheme) || !strings.EqualFold(value[:len(scheme)], scheme) || value[len(scheme)] != ' ' {
+			return "", false
+		}
+		return strings.TrimSpace(value[len(scheme)+1:]), true
+	}
+}
+
+// FromQuery read the token from the query parameter
+func FromQuery(name string) Extractor {
+	return func(r *http.Request) (string, bool) {
+		value := r.URL.Query().Get(name)
+		return value, value != ""
+	}
+}
+
+// FromCookie read the token from the cookie
+func FromCookie(name string) Extractor {
+	return func(r *http.Request) (string, bool) {
+		cookie, err := r.Cookie(name)
+		if err != nil {
+			return "", false
+		}
+		return cookie.Value, cookie.Value != ""
+	}
+}
+
+// FromSubprotocol read the token from the subprotocol prefixed by prefix in Sec-WebSocket-Protocol,
+// e.g. "access_token." for the subprotocols "chat, access_token.<token>".
+//
+// the subprotocol carried the token is never negotiated. the clients (e.g. browsers) fail the handshake
+// if no requested subprotocol is selected by server, so they should request a companion subprotocol
+// (e.g. "chat") supported by peregrine.WithSubprotocols along with the token
+func FromSubprotocol(prefix string) Extractor {
+	return func(r *http.Request) (string, bool) {
+		for _, value := range r.Header.Values("Sec-WebSocket-Protocol") {
+			for _, protocol := range strings.Split(value, ",") {
+				if token, ok := strings.CutPrefix(strings.TrimSpace(protocol), prefix); ok {
+					return token, true
+				}
+			}
+		}
+		return "", false
+	}
+}
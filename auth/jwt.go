@@ -0,0 +1,217 @@
+package auth
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"math"
+	"strings"
+	"time"
+)
+
+var (
+	ErrTokenMalformed       = errors.New("token malformed")
+	ErrTokenSignature       = errors.New("token signature invalid")
+	ErrTokenExpired         = errors.New("token expired")
+	ErrTokenNotValidYet     = errors.New("token not valid yet")
+	ErrTokenIssuer          = errors.New("token issuer invalid")
+	ErrTokenAudience        = errors.New("token audience invalid")
+	ErrUnsupportedAlgorithm = errors.New("unsupported algorithm")
+)
+
+type JWTOptionFunc func(*JWTVerifier)
+
+// WithHMACKey verify the HS256 tokens by secret
+func WithHMACKey(secret []byte) JWTOptionFunc {
+	return func(v *JWTVerifier) { v.secret = secret }
+}
+
+// WithRSAKey verify the RS256 tokens by the public key
+func WithRSAKey(key *rsa.PublicKey) JWTOptionFunc {
+	return func(v *JWTVerifier) { v.publicKey = key }
+}
+
+// WithIssuer the "iss" claim must be issuer
+func WithIssuer(issuer string) JWTOptionFunc {
+	return func(v *JWTVerifier) { v.issuer = issuer }
+}
+
+// WithAudience the "aud" claim must contain audience
+func WithAudience(audience string) JWTOptionFunc {
+	return func(v *JWTVerifier) { v.audience = audience }
+}
+
+// WithLeeway the clock skew allowed when validating "exp" and "nbf"
+func WithLeeway(leeway time.Duration) JWTOptionFunc {
+	return func(v *JWTVerifier) { v.leeway = leeway }
+}
+
+// JWTVerifier is an Authenticator verify the JSON Web Tokens (RFC 7519) signed by HS256 or RS256 with static keys,
+// the "sub" claim is used as the subject of principal
+type JWTVerifier struct {
+	secret    []byte
+	publicKey *rsa.PublicKey
+	issuer    string
+	audience  string
+	leeway    time.Duration
+
+	now func() time.Time
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+}
+
+func (v *JWTVerifier) Authenticate(token string) (*Principal, error) {
+	claims, err := v.Verify(token)
+	if err != nil {
+		return nil, err
+	}
+	subject, _ := claims["sub"].(string)
+	return &Principal{Subject: subject, Claims: claims}, nil
+}
+
+// Verify the token, returns the claims of token
+func (v *JWTVerifier) Verify(token string) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrTokenMalformed
+	}
+
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrTokenMalformed
+	}
+
+	signed := token[:len(parts[0])+1+len(parts[1])]
+	if err = v.verifySignature(header.Alg, signed, signature); err != nil {
+		return nil, err
+	}
+
+	claims := make(map[string]any)
+	if err = decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if err = v.validate(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func (v *JWTVerifier) verifySignature(alg, signed string, signature []byte) error {
+	switch {
+	case alg == "HS256" && v.secret != nil:
+		mac := hmac.New(sha256.New, v.secret)
+		mac.Write([]byte(signed))
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return ErrTokenSignature
+		}
+		return nil
+	case alg == "RS256" && v.publicKey != nil:
+		digest := sha256.Sum256([]byte(signed))
+		if rsa.VerifyPKCS1v15(v.publicKey, crypto.SHA256, digest[:], signature) != nil {
+			return ErrTokenSignature
+		}
+		return nil
+	default:
+		// "none" and the algorithms without key are never accepted
+		return errors.Wrap(ErrUnsupportedAlgorithm, alg)
+	}
+}
+
+// validate the registered claims (RFC 7519 4.1)
+func (v *JWTVerifier) validate(claims map[string]any) error {
+	now := v.now()
+
+	exp, ok, err := numericDate(claims, "exp")
+	if err != nil {
+		return err
+	}
+	if ok && !now.Before(exp.Add(v.leeway)) {
+		return ErrTokenExpired
+	}
+	nbf, ok, err := numericDate(claims, "nbf")
+	if err != nil {
+		return err
+	}
+	if ok && now.Add(v.leeway).Before(nbf) {
+		return ErrTokenNotValidYet
+	}
+	if v.issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != v.issuer {
+			return ErrTokenIssuer
+		}
+	}
+	if v.audience != "" && !hasAudience(claims["aud"], v.audience) {
+		return ErrTokenAudience
+	}
+	return nil
+}
+
+func decodeSegment(segment string, ptr any) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return ErrTokenMalformed
+	}
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+	if err = decoder.Decode(ptr); err != nil {
+		return ErrTokenMalformed
+	}
+	return nil
+}
+
+// numericDate returns the NumericDate claim of name, false if it's absent.
+// the claim present but not a number of seconds is malformed, it's never treated as absent
+func numericDate(claims map[string]any, name string) (time.Time, bool, error) {
+	value, ok := claims[name]
+	if !ok {
+		return time.Time{}, false, nil
+	}
+	n, ok := value.(json.Number)
+	if !ok {
+		return time.Time{}, false, errors.Wrap(ErrTokenMalformed, name)
+	}
+	if sec, err := n.Int64(); err == nil {
+		return time.Unix(sec, 0), true, nil
+	}
+	f, err := n.Float64()
+	if err != nil || math.IsNaN(f) || math.Abs(f) >= math.MaxInt64 {
+		return time.Time{}, false, errors.Wrap(ErrTokenMalformed, name)
+	}
+	// the seconds and fraction are converted apart, nanoseconds of int64 overflow after year 2262
+	sec := math.Floor(f)
+	return time.Unix(int64(sec), int64((f-sec)*float64(time.Second))), true, nil
+}
+
+// hasAudience the "aud" claim is a string or an array of strings
+func hasAudience(value any, audience string) bool {
+	switch aud := value.(type) {
+	case string:
+		return aud == audience
+	case []any:
+		for _, v := range aud {
+			if s, _ := v.(string); s == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func NewJWTVerifier(opts ...JWTOptionFunc) *JWTVerifier {
+	v := &JWTVerifier{now: time.Now}
+	for _, opt := range opts {
+		opt(v)
+	}
+	return v
+}
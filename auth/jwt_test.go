@@ -0,0 +1,134 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"testing"
+	"time"
+)
+
+var testSecret = []byte("peregrine")
+
+// signToken returns a token of claims signed by key, the key is []byte for HS256 or *rsa.PrivateKey for RS256
+func signToken(t testing.TB, alg string, key any, claims map[string]any) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	var signature []byte
+	switch key := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		digest := sha256.Sum256([]byte(signed))
+		var err error
+		if signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestJWTVerifier(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		now      = time.Now()
+		verifier = NewJWTVerifier(
+			WithHMACKey(testSecret),
+			WithRSAKey(&rsaKey.PublicKey),
+			WithIssuer("peregrine"),
+			WithAudience("chat"),
+			WithLeeway(time.Second),
+		)
+		claims = func(modify func(map[string]any)) map[string]any {
+			c := map[string]any{
+				"sub": "user-1",
+				"iss": "peregrine",
+				"aud": []string{"feed", "chat"},
+				"exp": now.Add(time.Minute).Unix(),
+				"nbf": now.Unix(),
+			}
+			if modify != nil {
+				modify(c)
+			}
+			return c
+		}
+	)
+
+	tests := []struct {
+		name  string
+		token string
+		err   error
+	}{
+		{name: "HS256", token: signToken(t, "HS256", testSecret, claims(nil))},
+		{name: "RS256", token: signToken(t, "RS256", rsaKey, claims(nil))},
+		{name: "HS256 wrong secret", token: signToken(t, "HS256", []byte("wrong"), claims(nil)), err: ErrTokenSignature},
+		{name: "RS256 wrong key", token: signToken(t, "RS256", otherKey, claims(nil)), err: ErrTokenSignature},
+		{name: "none", token: signToken(t, "none", nil, claims(nil)), err: ErrUnsupportedAlgorithm},
+		{name: "malformed", token: "peregrine", err: ErrTokenMalformed},
+		{name: "expired", token: signToken(t, "HS256", testSecret, claims(func(c map[string]any) {
+			c["exp"] = now.Add(-2 * time.Second).Unix()
+		})), err: ErrTokenExpired},
+		{name: "expired in leeway", token: signToken(t, "HS256", testSecret, claims(func(c map[string]any) {
+			c["exp"] = now.Unix()
+		}))},
+		{name: "expires after 2262", token: signToken(t, "HS256", testSecret, claims(func(c map[string]any) {
+			c["exp"] = 1e10
+		}))},
+		{name: "fractional expiry", token: signToken(t, "HS256", testSecret, claims(func(c map[string]any) {
+			c["exp"] = float64(now.Add(-2*time.Second).Unix()) + 0.5
+		})), err: ErrTokenExpired},
+		{name: "no expiry", token: signToken(t, "HS256", testSecret, claims(func(c map[string]any) {
+			delete(c, "exp")
+		}))},
+		{name: "string expiry", token: signToken(t, "HS256", testSecret, claims(func(c map[string]any) {
+			c["exp"] = "1700000000"
+		})), err: ErrTokenMalformed},
+		{name: "expiry out of range", token: signToken(t, "HS256", testSecret, claims(func(c map[string]any) {
+			c["exp"] = 1e19
+		})), err: ErrTokenMalformed},
+		{name: "null not before", token: signToken(t, "HS256", testSecret, claims(func(c map[string]any) {
+			c["nbf"] = nil
+		})), err: ErrTokenMalformed},
+		{name: "not valid yet", token: signToken(t, "HS256", testSecret, claims(func(c map[string]any) {
+			c["nbf"] = now.Add(time.Minute).Unix()
+		})), err: ErrTokenNotValidYet},
+		{name: "issuer", token: signToken(t, "HS256", testSecret, claims(func(c map[string]any) {
+			c["iss"] = "other"
+		})), err: ErrTokenIssuer},
+		{name: "audience", token: signToken(t, "HS256", testSecret, claims(func(c map[string]any) {
+			c["aud"] = "feed"
+		})), err: ErrTokenAudience},
+	}
+	for _, tt := range tests {
+		principal, err := verifier.Authenticate(tt.token)
+		if tt.err != nil {
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("%s: expect error %v, got: %v", tt.name, tt.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", tt.name, err)
+		}
+		if principal.Subject != "user-1" {
+			t.Fatalf("%s: unexpected subject: %s", tt.name, principal.Subject)
+		}
+	}
+}
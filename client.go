@@ -1,8 +1,10 @@
 package peregrine
 
 import (
+	"bytes"
 	"context"
 	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsflate"
 	"io"
 	"net/http"
 	"sync/atomic"
@@ -36,9 +38,10 @@ func (h *ClientHeader) WriteTo(w io.Writer) (int64, error) {
 }
 
 type Client struct {
-	dialer ws.Dialer
-	ctx    context.Context
-	addr   string
+	dialer      ws.Dialer
+	ctx         context.Context
+	addr        string
+	compression *CompressionOptions
 }
 
 func (c *Client) Dial(header *ClientHeader) (*ClientConn, error) {
@@ -57,19 +60,41 @@ func (c *Client) Dial(header *ClientHeader) (*ClientConn, error) {
 		dialer.Header = dialerHeader
 	}
 
-	conn, _, _, err := dialer.Dial(c.ctx, c.addr)
+	if c.compression != nil {
+		dialer.Extensions = append(dialer.Extensions[:len(dialer.Extensions):len(dialer.Extensions)],
+			c.compression.offer().Option(),
+		)
+	}
+
+	conn, _, handshake, err := dialer.Dial(c.ctx, c.addr)
 	if err != nil {
 		return nil, err
 	}
 
-	return &ClientConn{
+	clientConn := &ClientConn{
 		state: func() *atomic.Bool {
 			b := atomic.Bool{}
 			b.Store(true)
 			return &b
 		}(),
 		conn: conn,
-	}, nil
+	}
+
+	if c.compression != nil {
+		for _, extension := range handshake.Extensions {
+			if !bytes.Equal(extension.Name, wsflate.ExtensionNameBytes) {
+				continue
+			}
+			var params wsflate.Parameters
+			if err = params.Parse(extension); err != nil {
+				_ = conn.Close()
+				return nil, err
+			}
+			clientConn.useCompression(*c.compression, params)
+		}
+	}
+
+	return clientConn, nil
 }
 
 func NewClient(addr string, opts ...ClientOptionFunc) *Client {
@@ -1,15 +1,33 @@
 package peregrine
 
 import (
+	"bytes"
 	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsflate"
 	"github.com/gobwas/ws/wsutil"
+	"io"
 	"net"
 	"sync/atomic"
+	"unicode/utf8"
 )
 
 type ClientConn struct {
 	state *atomic.Bool
 	conn  net.Conn
+
+	// compressor and decompressor not nil if permessage-deflate negotiated
+	compressor   *compressor
+	decompressor *decompressor
+}
+
+func (c *ClientConn) useCompression(options CompressionOptions, params wsflate.Parameters) {
+	bits := params.ClientMaxWindowBits
+	if bits == 1 || (!bits.Defined() && options.ClientMaxWindowBits.Defined()) {
+		// the server accepted any window size, use the preferred one
+		bits = options.ClientMaxWindowBits
+	}
+	c.compressor = newCompressor(options.level(), options.MinSize, params.ClientNoContextTakeover, bits)
+	c.decompressor = newDecompressor(params.ServerNoContextTakeover)
 }
 
 func (c *ClientConn) close(statusCode ws.StatusCode, reason string) error {
@@ -36,23 +54,87 @@ func (c *ClientConn) Hijack() (net.Conn, error) {
 	return c.conn, nil
 }
 
-func (c *ClientConn) WriteText(p []byte) error {
+func (c *ClientConn) writeMessage(opCode ws.OpCode, p []byte) error {
 	if !c.state.Load() {
 		return net.ErrClosed
 	}
-	return wsutil.WriteClientText(c.conn, p)
+	if c.compressor == nil {
+		return wsutil.WriteClientMessage(c.conn, opCode, p)
+	}
+
+	// compressed messages must be written in the order of compression
+	c.compressor.mu.Lock()
+	defer c.compressor.mu.Unlock()
+
+	frame, err := c.compressor.frame(opCode, p)
+	if err != nil {
+		return err
+	}
+	if frame.Header.Rsv == 0 {
+		// not compressed, the payload is owned by caller
+		return ws.WriteFrame(c.conn, ws.MaskFrame(frame))
+	}
+	return ws.WriteFrame(c.conn, ws.MaskFrameInPlace(frame))
+}
+
+func (c *ClientConn) WriteText(p []byte) error {
+	return c.writeMessage(ws.OpText, p)
 }
 
 func (c *ClientConn) WriteBinary(p []byte) error {
-	if !c.state.Load() {
-		return net.ErrClosed
-	}
-	return wsutil.WriteClientBinary(c.conn, p)
+	return c.writeMessage(ws.OpBinary, p)
 }
 
 func (c *ClientConn) ReadMessages() ([]wsutil.Message, error) {
 	if !c.state.Load() {
 		return nil, net.ErrClosed
 	}
-	return wsutil.ReadServerMessage(c.conn, nil)
+	if c.decompressor == nil {
+		return wsutil.ReadServerMessage(c.conn, nil)
+	}
+	return c.readCompressedMessages()
+}
+
+// readCompressedMessages same as wsutil.ReadServerMessage, but inflate the compressed messages
+func (c *ClientConn) readCompressedMessages() ([]wsutil.Message, error) {
+	var (
+		messages []wsutil.Message
+		state    wsflate.MessageState
+	)
+
+	rd := wsutil.Reader{
+		Source:     c.conn,
+		State:      ws.StateClientSide | ws.StateExtended,
+		Extensions: []wsutil.RecvExtension{&state},
+		OnIntermediate: func(h ws.Header, r io.Reader) error {
+			payload, err := io.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			messages = append(messages, wsutil.Message{OpCode: h.OpCode, Payload: payload})
+			return nil
+		},
+	}
+
+	h, err := rd.NextFrame()
+	if err != nil {
+		return messages, err
+	}
+
+	buf := &bytes.Buffer{}
+	if _, err = buf.ReadFrom(&rd); err != nil {
+		return messages, err
+	}
+
+	payload := buf.Bytes()
+	if state.IsCompressed() {
+		if payload, err = c.decompressor.decompress(payload, 0); err != nil {
+			return messages, err
+		}
+	}
+	if h.OpCode == ws.OpText && !utf8.Valid(payload) {
+		return messages, wsutil.ErrInvalidUTF8
+	}
+
+	return append(messages, wsutil.Message{OpCode: h.OpCode, Payload: payload}), nil
 }
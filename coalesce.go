@@ -0,0 +1,164 @@
+package peregrine
+
+import (
+	"github.com/panjf2000/gnet/v2"
+	"sync"
+)
+
+// pendingFrame is an encoded frame waiting for the flush, callback (could be nil) is called once written
+type pendingFrame struct {
+	b        []byte
+	callback gnet.AsyncCallback
+}
+
+// coalescer collect the frames written to conn until the event-loop flush them with a single writev.
+//
+// the first frame schedules the flush, the frames written before the event-loop runs it are batched,
+// so the event-loop is woken once per batch instead of once per frame
+type coalescer struct {
+	conn *Conn
+	// s not nil if the max outbound buffer of server enabled
+	s *Server
+
+	mu      sync.Mutex
+	pending []pendingFrame
+	// size the bytes of pending frames
+	size int
+	// scheduled set if the flush has been scheduled and not run
+	scheduled bool
+
+	// flushing, bufs only accessed by the event-loop, reused by every flush
+	flushing []pendingFrame
+	bufs     [][]byte
+	// flushTask the cached flush
+	flushTask gnet.AsyncCallback
+}
+
+func newCoalescer(conn *Conn, s *Server) *coalescer {
+	w := &coalescer{conn: conn}
+	if s.maxOutbound > 0 {
+		w.s = s
+	}
+	w.flushTask = w.flush
+	return w
+}
+
+// write queue the frames, callback (could be nil) is called once the last one written
+func (w *coalescer) write(callback gnet.AsyncCallback, frames ...[]byte) error {
+	var (
+		n            int
+		newDroppable = true
+	)
+	for _, b := range frames {
+		n += len(b)
+		newDroppable = newDroppable && droppable(b)
+	}
+
+	w.mu.Lock()
+	if w.s != nil && w.size+n > w.s.maxOutbound {
+		// the pending frames alone exceeded the limit
+		buffered := w.size + n
+		evicted, ok := w.shed(n, newDroppable)
+		if !ok {
+			w.mu.Unlock()
+			w.reject(evicted, buffered)
+			if w.s.slowConsumerPolicy == SlowConsumerClose {
+				_ = w.s.CloseConn(w.conn, w.s.slowConsumerCloseCode, ErrSlowConsumer)
+			} else {
+				w.s.droppedFrames.Add(uint64(len(frames)))
+			}
+			return ErrSlowConsumer
+		}
+		if len(evicted) != 0 {
+			defer w.reject(evicted, buffered)
+		}
+	}
+	w.size += n
+	for i, b := range frames {
+		frame := pendingFrame{b: b}
+		if i == len(frames)-1 {
+			frame.callback = callback
+		}
+		w.pending = append(w.pending, frame)
+	}
+	if w.scheduled {
+		w.mu.Unlock()
+		return nil
+	}
+	w.scheduled = true
+	w.mu.Unlock()
+
+	// the empty writev is run by the event-loop in order with other writes, without a syscall
+	if err := w.conn.Conn.AsyncWritev(nil, w.flushTask); err != nil {
+		w.drop(err)
+		return err
+	}
+	return nil
+}
+
+// reject the frames evicted by the slow consumer policy
+func (w *coalescer) reject(evicted []pendingFrame, buffered int) {
+	for _, frame := range evicted {
+		if frame.callback != nil {
+			_ = frame.callback(w.conn.Conn, ErrSlowConsumer)
+		}
+	}
+	w.s.droppedFrames.Add(uint64(len(evicted)))
+	w.s.slowConsumer(w.conn, buffered)
+}
+
+// drop the pending frames which the flush failed to schedule
+func (w *coalescer) drop(err error) {
+	w.mu.Lock()
+	frames := w.pending
+	w.pending, w.scheduled = nil, false
+	w.size = 0
+	w.mu.Unlock()
+
+	for _, frame := range frames {
+		if frame.callback != nil {
+			_ = frame.callback(w.conn.Conn, err)
+		}
+	}
+}
+
+// flush write the pending frames, it's called by the event-loop
+func (w *coalescer) flush(c gnet.Conn, err error) error {
+	w.mu.Lock()
+	w.pending, w.flushing = w.flushing[:0], w.pending
+	size := w.size
+	w.size, w.scheduled = 0, false
+	w.mu.Unlock()
+
+	if w.s != nil && err == nil {
+		// the outbound buffer only can be accessed by the event-loop
+		if outbound := c.OutboundBuffered(); outbound+size > w.s.maxOutbound {
+			err = w.evict(c, w.s.maxOutbound-outbound)
+			w.s.slowConsumer(w.conn, outbound+size)
+		}
+	}
+
+	if err == nil && len(w.flushing) != 0 {
+		var n int64
+		for _, frame := range w.flushing {
+			if frame.b == nil {
+				// dropped by the slow consumer policy
+				continue
+			}
+			w.bufs = append(w.bufs, frame.b)
+			n += int64(len(frame.b))
+		}
+		w.conn.written.Add(n)
+		_, err = c.Writev(w.bufs)
+		clear(w.bufs)
+		w.bufs = w.bufs[:0]
+	}
+
+	for i, frame := range w.flushing {
+		if frame.b != nil && frame.callback != nil {
+			_ = frame.callback(c, err)
+		}
+		w.flushing[i] = pendingFrame{}
+	}
+	return nil
+}
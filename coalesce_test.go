@@ -0,0 +1,263 @@
+package peregrine
+
+import (
+	"github.com/gobwas/ws"
+	"github.com/panjf2000/gnet/v2"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// testLoop runs the asynchronous writes of loopConns in order, like the event-loop of gnet
+type testLoop struct {
+	mu    sync.Mutex
+	tasks []func()
+	wake  chan struct{}
+
+	// triggers the tasks enqueued, writes the write syscalls
+	triggers atomic.Int64
+	writes   atomic.Int64
+}
+
+func newTestLoop() *testLoop {
+	return &testLoop{wake: make(chan struct{}, 1)}
+}
+
+func (l *testLoop) trigger(task func()) {
+	l.triggers.Add(1)
+	l.mu.Lock()
+	l.tasks = append(l.tasks, task)
+	l.mu.Unlock()
+	select {
+	case l.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run the enqueued tasks, returns the count of them
+func (l *testLoop) run() int {
+	l.mu.Lock()
+	tasks := l.tasks
+	l.tasks = nil
+	l.mu.Unlock()
+	for _, task := range tasks {
+		task()
+	}
+	return len(tasks)
+}
+
+// serve run the tasks in a goroutine until the loop closed
+func (l *testLoop) serve() {
+	go func() {
+		for range l.wake {
+			l.run()
+		}
+	}()
+}
+
+// barrier wait for the tasks enqueued before it
+func (l *testLoop) barrier() {
+	done := make(chan struct{})
+	l.trigger(func() { close(done) })
+	<-done
+}
+
+// loopConn is a mockConn which asynchronous writes are run by the loop
+type loopConn struct {
+	mockConn
+	loop *testLoop
+	// discard the written bytes instead of buffering them
+	discard bool
+}
+
+func (c *loopConn) Write(p []byte) (int, error) {
+	c.loop.writes.Add(1)
+	if c.discard {
+		return len(p), nil
+	}
+	return c.outbound.Write(p)
+}
+
+func (c *loopConn) Writev(bs [][]byte) (int, error) {
+	// same as gnet, no syscall for the empty writev
+	if len(bs) == 0 {
+		return 0, nil
+	}
+	c.loop.writes.Add(1)
+	n := 0
+	for _, b := range bs {
+		n += len(b)
+		if !c.discard {
+			c.outbound.Write(b)
+		}
+	}
+	return n, nil
+}
+
+func (c *loopConn) AsyncWrite(p []byte, callback gnet.AsyncCallback) error {
+	c.loop.trigger(func() {
+		_, err := c.Write(p)
+		if callback != nil {
+			_ = callback(c, err)
+		}
+	})
+	return nil
+}
+
+func (c *loopConn) AsyncWritev(bs [][]byte, callback gnet.AsyncCallback) error {
+	c.loop.trigger(func() {
+		_, err := c.Writev(bs)
+		if callback != nil {
+			_ = callback(c, err)
+		}
+	})
+	return nil
+}
+
+func readFrames(t *testing.T, c *mockConn) []ws.Frame {
+	var frames []ws.Frame
+	for c.outbound.Len() != 0 {
+		frame, err := ws.ReadFrame(&c.outbound)
+		if err != nil {
+			t.Fatal(err)
+		}
+		frames = append(frames, frame)
+	}
+	return frames
+}
+
+func TestConn_WriteFrames(t *testing.T) {
+	var (
+		loop = newTestLoop()
+		c    = &loopConn{loop: loop}
+		conn = NewUpgraderConn(c)
+	)
+
+	if err := conn.WriteFrames(
+		ws.NewFrame(ws.OpText, false, []byte("pere")),
+		ws.NewPingFrame(nil),
+		ws.NewFrame(ws.OpContinuation, true, []byte("grine")),
+	); err != nil {
+		t.Fatal(err)
+	}
+	if n := loop.run(); n != 1 || loop.writes.Load() != 1 {
+		t.Fatalf("expect a single writev, got %d tasks, %d writes", n, loop.writes.Load())
+	}
+
+	frames := readFrames(t, &c.mockConn)
+	if len(frames) != 3 ||
+		frames[0].Header.OpCode != ws.OpText || frames[0].Header.Fin ||
+		frames[1].Header.OpCode != ws.OpPing ||
+		frames[2].Header.OpCode != ws.OpContinuation || string(frames[2].Payload) != "grine" {
+		t.Fatalf("unexpected frames: %v", frames)
+	}
+}
+
+func TestConn_WriteCoalescing(t *testing.T) {
+	var (
+		loop    = newTestLoop()
+		c       = &loopConn{loop: loop}
+		conn    = NewUpgraderConn(c)
+		written atomic.Bool
+	)
+	conn.coalescer = newCoalescer(conn, &Server{})
+
+	for _, p := range []string{"a", "b", "c"} {
+		if err := conn.WriteText([]byte(p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := conn.WriteFrames(ws.NewTextFrame([]byte("d")), ws.NewTextFrame([]byte("e"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.AsyncWriteMessage(ws.OpText, []byte("f"), func(_ gnet.Conn, err error) error {
+		written.Store(err == nil)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the frames written before the event-loop runs are flushed together
+	if loop.triggers.Load() != 1 {
+		t.Fatalf("expect the event-loop woken once, got: %d", loop.triggers.Load())
+	}
+	loop.run()
+	if loop.writes.Load() != 1 || !written.Load() {
+		t.Fatalf("expect a single writev, got: %d", loop.writes.Load())
+	}
+	if conn.written.Load() != int64(c.outbound.Len()) {
+		t.Fatalf("expect %d bytes written, got: %d", c.outbound.Len(), conn.written.Load())
+	}
+
+	var payloads string
+	for _, frame := range readFrames(t, &c.mockConn) {
+		payloads += string(frame.Payload)
+	}
+	if payloads != "abcdef" {
+		t.Fatalf("unexpected order of frames: %s", payloads)
+	}
+
+	// the next write schedules another flush
+	_ = conn.WriteText([]byte("g"))
+	if loop.triggers.Load() != 2 || loop.run() != 1 {
+		t.Fatal("flush not scheduled after the last one")
+	}
+}
+
+func TestServer_WriteCoalescing(t *testing.T) {
+	s := NewServer("tcp://127.0.0.1:0", WithWriteCoalescing())
+	c, conn := upgradeMockConn(t, s)
+	if conn.coalescer == nil {
+		t.Fatal("write coalescing not enabled")
+	}
+
+	_ = conn.WriteText([]byte("peregrine"))
+	frames := readFrames(t, c)
+	if len(frames) != 1 || string(frames[0].Payload) != "peregrine" {
+		t.Fatalf("unexpected frames: %v", frames)
+	}
+}
+
+const (
+	fanOutConns = 10000
+	fanOutBurst = 8
+)
+
+// BenchmarkServer_FanOut the throughput of writing a burst of messages from 1 publisher to 10k conns
+func BenchmarkServer_FanOut(b *testing.B) {
+	for _, bench := range []struct {
+		name     string
+		coalesce bool
+	}{{"async-write", false}, {"coalescing", true}} {
+		b.Run(bench.name, func(b *testing.B) {
+			loop := newTestLoop()
+			loop.serve()
+			defer close(loop.wake)
+
+			conns := make([]*Conn, fanOutConns)
+			for i := range conns {
+				conns[i] = NewUpgraderConn(&loopConn{loop: loop, discard: true})
+				if bench.coalesce {
+					conns[i].coalescer = newCoalescer(conns[i], &Server{})
+				}
+			}
+			pm := NewPreparedMessage(ws.OpText, []byte("peregrine fan-out"))
+
+			b.ReportAllocs()
+			b.SetBytes(int64(len(pm.frame) * fanOutBurst * fanOutConns))
+			b.ResetTimer()
+			loop.triggers.Store(0)
+			loop.writes.Store(0)
+			for i := 0; i < b.N; i++ {
+				for j := 0; j < fanOutBurst; j++ {
+					for _, conn := range conns {
+						_ = conn.WritePreparedMessage(pm)
+					}
+				}
+				loop.barrier()
+			}
+			b.ReportMetric(float64(loop.triggers.Load())/float64(b.N), "triggers/op")
+			b.ReportMetric(float64(loop.writes.Load())/float64(b.N), "writes/op")
+		})
+	}
+}
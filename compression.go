@@ -0,0 +1,272 @@
+package peregrine
+
+import (
+	"bytes"
+	"compress/flate"
+	"github.com/gobwas/httphead"
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsflate"
+	"io"
+	"sync"
+)
+
+const (
+	// maxWindowBits the LZ77 sliding window used by compress/flate, 2^15
+	maxWindowBits wsflate.WindowBits = 15
+)
+
+var (
+	// compressionTail appended to the compressed message before inflating it.
+	// an empty stored block (removed by the sender, RFC 7692 7.2.1) followed by a final empty block
+	compressionTail = []byte{0x00, 0x00, 0xff, 0xff, 0x01, 0x00, 0x00, 0xff, 0xff}
+
+	// syncFlushTail the empty stored block produced by flate.Writer.Flush
+	syncFlushTail = []byte{0x00, 0x00, 0xff, 0xff}
+)
+
+// CompressionOptions configure the permessage-deflate extension (RFC 7692)
+type CompressionOptions struct {
+	// ServerNoContextTakeover the server resets its compression context after each message
+	ServerNoContextTakeover bool
+
+	// ClientNoContextTakeover the client resets its compression context after each message
+	ClientNoContextTakeover bool
+
+	// ServerMaxWindowBits limit the LZ77 sliding window of the server (8~15), zero means 15
+	ServerMaxWindowBits wsflate.WindowBits
+
+	// ClientMaxWindowBits limit the LZ77 sliding window of the client (8~15), zero means 15
+	ClientMaxWindowBits wsflate.WindowBits
+
+	// Level the compression level of compress/flate, zero means flate.DefaultCompression
+	Level int
+
+	// MinSize messages smaller than MinSize are sent uncompressed
+	MinSize int
+}
+
+func (o CompressionOptions) level() int {
+	if o.Level == 0 {
+		return flate.DefaultCompression
+	}
+	return o.Level
+}
+
+// accept negotiate the offer of client, returns the parameters accepted by server
+func (o CompressionOptions) accept(offer wsflate.Parameters) wsflate.Parameters {
+	accept := wsflate.Parameters{
+		ServerNoContextTakeover: o.ServerNoContextTakeover || offer.ServerNoContextTakeover,
+		ClientNoContextTakeover: o.ClientNoContextTakeover || offer.ClientNoContextTakeover,
+		ServerMaxWindowBits:     windowBits(o.ServerMaxWindowBits),
+	}
+
+	if offer.ServerMaxWindowBits.Defined() && offer.ServerMaxWindowBits < accept.ServerMaxWindowBits {
+		accept.ServerMaxWindowBits = offer.ServerMaxWindowBits
+	}
+	if accept.ServerMaxWindowBits == maxWindowBits && !offer.ServerMaxWindowBits.Defined() {
+		// same as default, no need to respond
+		accept.ServerMaxWindowBits = 0
+	}
+
+	// client_max_window_bits can only be responded if the client offered it
+	switch bits := windowBits(o.ClientMaxWindowBits); {
+	case !offer.ClientMaxWindowBits.Defined():
+	case offer.ClientMaxWindowBits == 1:
+		// offered without value, means the client supports any value
+		if bits != maxWindowBits {
+			accept.ClientMaxWindowBits = bits
+		}
+	case bits < offer.ClientMaxWindowBits:
+		accept.ClientMaxWindowBits = bits
+	default:
+		accept.ClientMaxWindowBits = offer.ClientMaxWindowBits
+	}
+
+	return accept
+}
+
+// offer returns the parameters offered by client
+func (o CompressionOptions) offer() wsflate.Parameters {
+	offer := wsflate.Parameters{
+		ServerNoContextTakeover: o.ServerNoContextTakeover,
+		ClientNoContextTakeover: o.ClientNoContextTakeover,
+		// announce client_max_window_bits is supported
+		ClientMaxWindowBits: 1,
+	}
+	if o.ServerMaxWindowBits.Defined() && o.ServerMaxWindowBits < maxWindowBits {
+		offer.ServerMaxWindowBits = o.ServerMaxWindowBits
+	}
+	if o.ClientMaxWindowBits.Defined() && o.ClientMaxWindowBits < maxWindowBits {
+		offer.ClientMaxWindowBits = o.ClientMaxWindowBits
+	}
+	return offer
+}
+
+// negotiate returns the Negotiate function of ws.Upgrader,
+// the accepted parameters are passed to onAccept
+func (o CompressionOptions) negotiate(onAccept func(params wsflate.Parameters)) func(httphead.Option) (httphead.Option, error) {
+	accepted := false
+	return func(opt httphead.Option) (httphead.Option, error) {
+		if accepted || !bytes.Equal(opt.Name, wsflate.ExtensionNameBytes) {
+			return httphead.Option{}, nil
+		}
+
+		var offer wsflate.Parameters
+		if err := offer.Parse(opt); err != nil {
+			// skip the malformed offer
+			return httphead.Option{}, nil
+		}
+
+		params := o.accept(offer)
+		accepted = true
+		onAccept(params)
+		return params.Option(), nil
+	}
+}
+
+func windowBits(bits wsflate.WindowBits) wsflate.WindowBits {
+	if !bits.Defined() || bits > maxWindowBits {
+		return maxWindowBits
+	}
+	return bits
+}
+
+// compressor compress the outbound messages of a connection
+type compressor struct {
+	mu sync.Mutex
+
+	fw  *flate.Writer
+	buf bytes.Buffer
+
+	// contextTakeover keep the LZ77 sliding window across messages
+	contextTakeover bool
+
+	// minSize messages smaller than minSize are not compressed
+	minSize int
+
+	// maxSize messages larger than maxSize are not compressed, zero means no limit.
+	// compress/flate always uses a 2^15 window, if a smaller window was negotiated,
+	// only messages not larger than the window are compressed without context takeover
+	maxSize int
+}
+
+func newCompressor(level, minSize int, noContextTakeover bool, bits wsflate.WindowBits) *compressor {
+	c := &compressor{
+		contextTakeover: !noContextTakeover,
+		minSize:         minSize,
+	}
+	if bits = windowBits(bits); bits < maxWindowBits {
+		c.contextTakeover = false
+		c.maxSize = bits.Bytes()
+	}
+	c.fw, _ = flate.NewWriter(&c.buf, level)
+	return c
+}
+
+// compress p into a new slice, ok is false if p should be sent uncompressed.
+//
+// with context takeover, the compressed messages must be sent in the order of compress called
+func (c *compressor) compress(p []byte) (compressed []byte, ok bool, err error) {
+	if len(p) < c.minSize || (c.maxSize != 0 && len(p) > c.maxSize) {
+		return nil, false, nil
+	}
+
+	c.buf.Reset()
+	if !c.contextTakeover {
+		c.fw.Reset(&c.buf)
+	}
+
+	if _, err = c.fw.Write(p); err != nil {
+		return nil, false, err
+	}
+	if err = c.fw.Flush(); err != nil {
+		return nil, false, err
+	}
+
+	// remove the tail of sync flush, RFC 7692 7.2.1
+	out := bytes.TrimSuffix(c.buf.Bytes(), syncFlushTail)
+	compressed = make([]byte, len(out))
+	copy(compressed, out)
+	return compressed, true, nil
+}
+
+// frame build a frame of the message, the payload is compressed if possible
+func (c *compressor) frame(opCode ws.OpCode, p []byte) (ws.Frame, error) {
+	frame := ws.NewFrame(opCode, true, p)
+	if !opCode.IsData() {
+		return frame, nil
+	}
+
+	compressed, ok, err := c.compress(p)
+	if err != nil || !ok {
+		return frame, err
+	}
+
+	frame.Payload = compressed
+	frame.Header.Length = int64(len(compressed))
+	frame.Header.Rsv = ws.Rsv(true, false, false)
+	return frame, nil
+}
+
+// decompressor inflate the inbound messages of a connection
+type decompressor struct {
+	fr  io.ReadCloser
+	buf bytes.Buffer
+
+	// contextTakeover keep the LZ77 sliding window across messages
+	contextTakeover bool
+
+	// window the last decompressed data, used as the preset dictionary of next message
+	window []byte
+}
+
+func newDecompressor(noContextTakeover bool) *decompressor {
+	return &decompressor{
+		contextTakeover: !noContextTakeover,
+	}
+}
+
+// decompress the payload of a compressed message into a new slice,
+// returns ErrMessageTooBig if the decompressed size exceeded maxSize (zero means unlimited)
+func (d *decompressor) decompress(p []byte, maxSize int64) ([]byte, error) {
+	src := io.MultiReader(bytes.NewReader(p), bytes.NewReader(compressionTail))
+	if d.fr == nil {
+		d.fr = flate.NewReaderDict(src, d.window)
+	} else if err := d.fr.(flate.Resetter).Reset(src, d.window); err != nil {
+		return nil, err
+	}
+
+	var r io.Reader = d.fr
+	if maxSize > 0 {
+		r = io.LimitReader(d.fr, maxSize+1)
+	}
+
+	d.buf.Reset()
+	if _, err := d.buf.ReadFrom(r); err != nil {
+		return nil, err
+	}
+	if maxSize > 0 && int64(d.buf.Len()) > maxSize {
+		return nil, ErrMessageTooBig
+	}
+
+	out := make([]byte, d.buf.Len())
+	copy(out, d.buf.Bytes())
+
+	if d.contextTakeover {
+		d.slide(out)
+	}
+	return out, nil
+}
+
+// slide append p into the window, keep the last 2^15 bytes
+func (d *decompressor) slide(p []byte) {
+	size := maxWindowBits.Bytes()
+	if len(p) >= size {
+		d.window = append(d.window[:0], p[len(p)-size:]...)
+		return
+	}
+	if overflow := len(d.window) + len(p) - size; overflow > 0 {
+		d.window = append(d.window[:0], d.window[overflow:]...)
+	}
+	d.window = append(d.window, p...)
+}
@@ -0,0 +1,113 @@
+package peregrine
+
+import (
+	"bytes"
+	"compress/flate"
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsflate"
+	"testing"
+)
+
+func TestCompression_ContextTakeover(t *testing.T) {
+	for _, noContextTakeover := range []bool{false, true} {
+		var (
+			c = newCompressor(flate.BestCompression, 0, noContextTakeover, 0)
+			d = newDecompressor(noContextTakeover)
+
+			sizes []int
+		)
+
+		for i := 0; i < 8; i++ {
+			message := bytes.Repeat([]byte(`{"type":1,"msg":"peregrine"}`), 64)
+			compressed, ok, err := c.compress(message)
+			if err != nil || !ok {
+				t.Fatalf("compress error: %v, %v", ok, err)
+			}
+			sizes = append(sizes, len(compressed))
+
+			inflated, err := d.decompress(compressed, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(inflated, message) {
+				t.Fatal("inflated message mismatch")
+			}
+		}
+
+		// the repeated message only costs a back reference with context takeover
+		if takeover := sizes[1] < sizes[0]; takeover == noContextTakeover {
+			t.Fatalf("unexpected compressed sizes: %v, no context takeover: %v", sizes, noContextTakeover)
+		}
+	}
+}
+
+func TestCompression_WindowBits(t *testing.T) {
+	c := newCompressor(flate.DefaultCompression, 16, false, 9)
+
+	if _, ok, _ := c.compress(make([]byte, 8)); ok {
+		t.Fatal("message smaller than min size compressed")
+	}
+	if _, ok, _ := c.compress(make([]byte, 1024)); ok {
+		t.Fatal("message larger than the window compressed")
+	}
+	if _, ok, _ := c.compress(make([]byte, 512)); !ok {
+		t.Fatal("message not compressed")
+	}
+}
+
+func TestCompression_Accept(t *testing.T) {
+	options := CompressionOptions{ClientMaxWindowBits: 10}
+
+	accept := options.accept(wsflate.Parameters{
+		ServerMaxWindowBits: 12,
+		ClientMaxWindowBits: 1,
+	})
+	if accept.ServerMaxWindowBits != 12 || accept.ClientMaxWindowBits != 10 {
+		t.Fatalf("unexpected accepted parameters: %+v", accept)
+	}
+
+	// client_max_window_bits must not be responded if not offered
+	if accept = options.accept(wsflate.Parameters{}); accept.ClientMaxWindowBits.Defined() {
+		t.Fatalf("unexpected accepted parameters: %+v", accept)
+	}
+}
+
+func TestDecoder_Compressed(t *testing.T) {
+	var (
+		c       = &mockConn{}
+		d       = &decoder{decompressor: newDecompressor(false)}
+		message = bytes.Repeat([]byte("peregrine"), 128)
+	)
+
+	frame, err := newCompressor(flate.DefaultCompression, 0, false, 0).frame(ws.OpText, message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.inbound.Write(compileClientFrame(t, frame))
+
+	messages, err := d.Decode(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 || !bytes.Equal(messages[0].Payload, message) {
+		t.Fatalf("unexpected messages: %v", messages)
+	}
+
+	// compression bit is only allowed on the first frame
+	for _, h := range []ws.Header{
+		{Fin: true, OpCode: ws.OpPing, Rsv: ws.Rsv(true, false, false)},
+		{Fin: true, OpCode: ws.OpContinuation, Rsv: ws.Rsv(true, false, false)},
+	} {
+		var (
+			c = &mockConn{}
+			d = &decoder{decompressor: newDecompressor(false)}
+		)
+		if h.OpCode == ws.OpContinuation {
+			c.inbound.Write(compileClientFrame(t, ws.Frame{Header: ws.Header{OpCode: ws.OpText, Rsv: ws.Rsv(true, false, false)}}))
+		}
+		c.inbound.Write(compileClientFrame(t, ws.Frame{Header: h}))
+		if _, err = d.Decode(c); err != ws.ErrProtocolNonZeroRsv {
+			t.Fatalf("%v: expect %v, got: %v", h.OpCode, ws.ErrProtocolNonZeroRsv, err)
+		}
+	}
+}
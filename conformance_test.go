@@ -0,0 +1,345 @@
+package peregrine_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"github.com/RealFax/peregrine"
+	"github.com/gobwas/ws"
+	"github.com/panjf2000/gnet/v2"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+const conformanceAddr = "127.0.0.1:19311"
+
+// conformanceCase is a test case modeled on the Autobahn testsuite
+type conformanceCase struct {
+	name string
+	// frames sent by client
+	frames []ws.Frame
+	// expect the frames echoed by server before the close frame
+	expect []ws.Frame
+	// closeCode the status code of the close frame of server, zero means an empty close frame
+	closeCode ws.StatusCode
+}
+
+func frame(opCode ws.OpCode, fin bool, payload string) ws.Frame {
+	return ws.NewFrame(opCode, fin, []byte(payload))
+}
+
+func closeFrame(code ws.StatusCode, reason string) ws.Frame {
+	return ws.NewCloseFrame(ws.NewCloseFrameBody(code, reason))
+}
+
+func withRsv(f ws.Frame, rsv byte) ws.Frame {
+	f.Header.Rsv = rsv
+	return f
+}
+
+func conformanceCases() []conformanceCase {
+	var (
+		normalClose = closeFrame(ws.StatusNormalClosure, "")
+		invalidUTF8 = string([]byte{0xce, 0xba, 0xe1, 0xbd, 0xb9, 0xcf, 0x83, 0xce, 0xbc, 0xce, 0xb5, 0xed, 0xa0, 0x80})
+		euro        = "€"
+	)
+
+	return []conformanceCase{
+		// 1.* framing
+		{
+			name:      "1.1.1 text empty",
+			frames:    []ws.Frame{ws.NewTextFrame(nil), normalClose},
+			expect:    []ws.Frame{ws.NewTextFrame(nil)},
+			closeCode: ws.StatusNormalClosure,
+		},
+		{
+			name:      "1.1.5 text 128 bytes",
+			frames:    []ws.Frame{frame(ws.OpText, true, strings.Repeat("*", 128)), normalClose},
+			expect:    []ws.Frame{frame(ws.OpText, true, strings.Repeat("*", 128))},
+			closeCode: ws.StatusNormalClosure,
+		},
+		{
+			name:      "1.2.6 binary 65536 bytes",
+			frames:    []ws.Frame{frame(ws.OpBinary, true, strings.Repeat("\xfe", 65536)), normalClose},
+			expect:    []ws.Frame{frame(ws.OpBinary, true, strings.Repeat("\xfe", 65536))},
+			closeCode: ws.StatusNormalClosure,
+		},
+
+		// 2.* ping / pong
+		{
+			name:      "2.3 ping with binary payload",
+			frames:    []ws.Frame{frame(ws.OpPing, true, "\x00\xff\xfe\xfd\xfc\xfb\x00\xff"), normalClose},
+			expect:    []ws.Frame{frame(ws.OpPong, true, "\x00\xff\xfe\xfd\xfc\xfb\x00\xff")},
+			closeCode: ws.StatusNormalClosure,
+		},
+		{
+			name:      "2.4 ping with 125 bytes payload",
+			frames:    []ws.Frame{frame(ws.OpPing, true, strings.Repeat("\xfe", 125)), normalClose},
+			expect:    []ws.Frame{frame(ws.OpPong, true, strings.Repeat("\xfe", 125))},
+			closeCode: ws.StatusNormalClosure,
+		},
+		{
+			name:      "2.5 ping with 126 bytes payload",
+			frames:    []ws.Frame{frame(ws.OpPing, true, strings.Repeat("\xfe", 126))},
+			closeCode: ws.StatusProtocolError,
+		},
+		{
+			name:      "2.7 unsolicited pong",
+			frames:    []ws.Frame{frame(ws.OpPong, true, "unsolicited"), normalClose},
+			closeCode: ws.StatusNormalClosure,
+		},
+
+		// 3.* reserved bits
+		{
+			name:      "3.1 rsv 1",
+			frames:    []ws.Frame{withRsv(frame(ws.OpText, true, "Hello"), ws.Rsv(false, false, true))},
+			closeCode: ws.StatusProtocolError,
+		},
+		{
+			name:      "3.5 rsv 5 on binary",
+			frames:    []ws.Frame{withRsv(frame(ws.OpBinary, true, "\x00\xff"), ws.Rsv(true, false, true))},
+			closeCode: ws.StatusProtocolError,
+		},
+		{
+			name:      "3.7 rsv 7 on close frame",
+			frames:    []ws.Frame{withRsv(normalClose, ws.Rsv(true, true, true))},
+			closeCode: ws.StatusProtocolError,
+		},
+
+		// 4.* opcodes
+		{
+			name:      "4.1.1 reserved non-control opcode 3",
+			frames:    []ws.Frame{frame(0x3, true, "")},
+			closeCode: ws.StatusProtocolError,
+		},
+		{
+			name:      "4.2.1 reserved control opcode 11",
+			frames:    []ws.Frame{frame(0xb, true, "")},
+			closeCode: ws.StatusProtocolError,
+		},
+
+		// 5.* fragmentation
+		{
+			name:      "5.1 fragmented ping",
+			frames:    []ws.Frame{frame(ws.OpPing, false, "frag1"), frame(ws.OpContinuation, true, "frag2")},
+			closeCode: ws.StatusProtocolError,
+		},
+		{
+			name: "5.6 ping between fragments",
+			frames: []ws.Frame{
+				frame(ws.OpText, false, "frag1"),
+				frame(ws.OpPing, true, "ping"),
+				frame(ws.OpContinuation, true, "frag2"),
+				normalClose,
+			},
+			expect:    []ws.Frame{frame(ws.OpPong, true, "ping"), frame(ws.OpText, true, "frag1frag2")},
+			closeCode: ws.StatusNormalClosure,
+		},
+		{
+			name:      "5.9 unexpected continuation",
+			frames:    []ws.Frame{frame(ws.OpContinuation, true, "frag")},
+			closeCode: ws.StatusProtocolError,
+		},
+		{
+			name:      "5.18 text while fragmented",
+			frames:    []ws.Frame{frame(ws.OpText, false, "frag1"), frame(ws.OpText, true, "frag2")},
+			closeCode: ws.StatusProtocolError,
+		},
+
+		// 6.* UTF-8
+		{
+			name: "6.2.4 code point split in fragments",
+			frames: []ws.Frame{
+				frame(ws.OpText, false, euro[:1]),
+				frame(ws.OpContinuation, false, euro[1:2]),
+				frame(ws.OpContinuation, true, euro[2:]),
+				normalClose,
+			},
+			expect:    []ws.Frame{frame(ws.OpText, true, euro)},
+			closeCode: ws.StatusNormalClosure,
+		},
+		{
+			name:      "6.3.1 invalid UTF-8",
+			frames:    []ws.Frame{frame(ws.OpText, true, invalidUTF8)},
+			closeCode: ws.StatusInvalidFramePayloadData,
+		},
+		{
+			name:      "6.3.2 invalid UTF-8 in fragments",
+			frames:    []ws.Frame{frame(ws.OpText, false, invalidUTF8[:5]), frame(ws.OpContinuation, true, invalidUTF8[5:])},
+			closeCode: ws.StatusInvalidFramePayloadData,
+		},
+
+		// 7.* close handshake
+		{
+			name:      "7.1.1 close after echoed message",
+			frames:    []ws.Frame{frame(ws.OpText, true, "Hello"), normalClose},
+			expect:    []ws.Frame{frame(ws.OpText, true, "Hello")},
+			closeCode: ws.StatusNormalClosure,
+		},
+		{
+			name:   "7.3.1 close without payload",
+			frames: []ws.Frame{ws.NewCloseFrame(nil)},
+		},
+		{
+			name:      "7.3.2 close with 1 byte payload",
+			frames:    []ws.Frame{ws.NewCloseFrame([]byte{0x03})},
+			closeCode: ws.StatusProtocolError,
+		},
+		{
+			name:      "7.3.6 close with 125 bytes payload",
+			frames:    []ws.Frame{closeFrame(ws.StatusNormalClosure, strings.Repeat("*", 123))},
+			closeCode: ws.StatusNormalClosure,
+		},
+		{
+			name:      "7.5.1 close with invalid UTF-8 reason",
+			frames:    []ws.Frame{closeFrame(ws.StatusNormalClosure, invalidUTF8)},
+			closeCode: ws.StatusInvalidFramePayloadData,
+		},
+		{
+			name:      "7.7.x close with valid code",
+			frames:    []ws.Frame{closeFrame(1013, "")},
+			closeCode: 1013,
+		},
+		{
+			name:      "7.7.x close with private code",
+			frames:    []ws.Frame{closeFrame(4999, "")},
+			closeCode: 4999,
+		},
+		{
+			name:      "7.9.x close with reserved code 1005",
+			frames:    []ws.Frame{closeFrame(ws.StatusNoStatusRcvd, "")},
+			closeCode: ws.StatusProtocolError,
+		},
+		{
+			name:      "7.9.x close with code 999",
+			frames:    []ws.Frame{closeFrame(999, "")},
+			closeCode: ws.StatusProtocolError,
+		},
+		{
+			name:      "7.9.x close with code 5000",
+			frames:    []ws.Frame{closeFrame(5000, "")},
+			closeCode: ws.StatusProtocolError,
+		},
+	}
+}
+
+// writeClientFrame write a masked frame, the header is written as it is
+func writeClientFrame(w io.Writer, f ws.Frame) error {
+	f.Header.Masked = true
+	f.Header.Length = int64(len(f.Payload))
+	if _, err := rand.Read(f.Header.Mask[:]); err != nil {
+		return err
+	}
+
+	payload := make([]byte, len(f.Payload))
+	copy(payload, f.Payload)
+	ws.Cipher(payload, f.Header.Mask, 0)
+
+	if err := ws.WriteHeader(w, f.Header); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+func runConformanceCase(t *testing.T, c conformanceCase) {
+	conn, _, _, err := ws.Dial(context.Background(), "ws://"+conformanceAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(3 * time.Second))
+
+	// frames are written at once, the server may fail the conn before the rest of frames arrived
+	var buf bytes.Buffer
+	for _, f := range c.frames {
+		if err = writeClientFrame(&buf, f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = conn.Write(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	var received []ws.Frame
+	for {
+		f, rerr := ws.ReadFrame(conn)
+		if rerr != nil {
+			t.Fatalf("read frame error: %v", rerr)
+		}
+		if f.Header.Masked || f.Header.Rsv != 0 || !f.Header.Fin {
+			t.Fatalf("unexpected frame header: %+v", f.Header)
+		}
+		if f.Header.OpCode == ws.OpClose {
+			if c.closeCode == 0 {
+				if len(f.Payload) != 0 {
+					t.Fatalf("expect empty close frame, got: %v", f.Payload)
+				}
+			} else if code, _ := ws.ParseCloseFrameData(f.Payload); code != c.closeCode {
+				t.Fatalf("expect close code %d, got: %d", c.closeCode, code)
+			}
+			break
+		}
+		received = append(received, f)
+	}
+
+	if len(received) != len(c.expect) {
+		t.Fatalf("expect %d frames, got: %d", len(c.expect), len(received))
+	}
+	for i, f := range received {
+		if f.Header.OpCode != c.expect[i].Header.OpCode || !bytes.Equal(f.Payload, c.expect[i].Payload) {
+			t.Fatalf("frame %d mismatch, opcode: %v, length: %d", i, f.Header.OpCode, len(f.Payload))
+		}
+	}
+
+	// the server closes the TCP connection after the close frame
+	if _, err = conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("conn not closed by server")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("conn not closed by server")
+	}
+}
+
+func TestServer_Conformance(t *testing.T) {
+	t.Run("default", func(t *testing.T) {
+		testConformance(t)
+	})
+	// the echoes and close frames are written in order with the write coalescing
+	t.Run("coalescing", func(t *testing.T) {
+		testConformance(t, peregrine.WithWriteCoalescing())
+	})
+}
+
+func testConformance(t *testing.T, opts ...peregrine.OptionFunc) {
+	server := peregrine.NewServer(
+		"tcp://"+conformanceAddr,
+		append([]peregrine.OptionFunc{
+			peregrine.WithStrictProtocol(),
+			peregrine.WithDispatchMode(peregrine.DispatchOrdered),
+			peregrine.WithHandler(func(packet *peregrine.Packet) {
+				_ = packet.Conn.WriteMessage(packet.OpCode, packet.Request)
+			}),
+		}, opts...)...,
+	)
+
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- server.ListenAndServe(gnet.WithReuseAddr(true))
+	}()
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_ = server.Shutdown(ctx)
+		<-stopped
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	for _, c := range conformanceCases() {
+		t.Run(c.name, func(t *testing.T) {
+			runConformanceCase(t, c)
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package peregrine
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"testing"
+)
+
+func TestConn_Context(t *testing.T) {
+	type key struct{}
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), key{}, "peregrine"))
+	defer cancel()
+	s := NewServer("tcp://127.0.0.1:0", WithContext(ctx))
+
+	t.Run("closed", func(t *testing.T) {
+		c, conn := upgradeMockConn(t, s)
+		if conn.Context().Value(key{}) != "peregrine" {
+			t.Fatal("context not derived from the server context")
+		}
+		if conn.Context().Err() != nil {
+			t.Fatal("context canceled before closed")
+		}
+
+		s.OnClose(c, nil)
+		<-conn.Context().Done()
+		if cause := context.Cause(conn.Context()); !errors.Is(cause, ErrConnClosed) {
+			t.Fatalf("unexpected cause: %v", cause)
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		c, conn := upgradeMockConn(t, s)
+		conn.setCloseReason(ErrIdleTimeout)
+		s.OnClose(c, nil)
+		if cause := context.Cause(conn.Context()); !errors.Is(cause, ErrIdleTimeout) {
+			t.Fatalf("unexpected cause: %v", cause)
+		}
+	})
+
+	t.Run("server", func(t *testing.T) {
+		_, conn := upgradeMockConn(t, s)
+		cancel()
+		<-conn.Context().Done()
+		if !errors.Is(context.Cause(conn.Context()), context.Canceled) {
+			t.Fatal("context not canceled with the server context")
+		}
+	})
+}
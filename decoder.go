@@ -0,0 +1,333 @@
+package peregrine
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsflate"
+	"github.com/panjf2000/gnet/v2"
+	"github.com/pkg/errors"
+	"io"
+)
+
+var (
+	headerTerminator = []byte("\r\n\r\n")
+
+	ErrMessageTooBig = errors.New("message too big")
+)
+
+// decoder is an incremental websocket frame decoder bound to a Conn.
+//
+// it only consumes complete frames from the gnet inbound buffer (Peek/Discard),
+// incomplete frames stay in the buffer until the next OnTraffic.
+// fragmented messages are reassembled into a single message.
+type decoder struct {
+	// fragmented whether a fragmented message is being reassembled
+	fragmented bool
+	// opCode of the fragmented message
+	opCode ws.OpCode
+	// fragments payload of the fragmented message received so far
+	fragments []byte
+	// compressed whether the message being received is compressed
+	compressed bool
+
+	// decompressor not nil if permessage-deflate negotiated
+	decompressor *decompressor
+
+	// maxSize the max size of message, zero means unlimited
+	maxSize int64
+
+	// sink not nil in streaming mode, the payload of uncompressed data messages is written to it as it arrives
+	sink streamSink
+	// streaming whether a data frame is being streamed, frame the header of it
+	streaming bool
+	frame     ws.Header
+	// remaining the payload bytes of frame not received, offset the payload bytes received
+	remaining int64
+	offset    int
+	// size the payload bytes of the streaming message so far
+	size int64
+
+	// messages returned by Decode, reused by the next Decode
+	messages []message
+}
+
+// streamSink receives the payload of data messages in streaming mode, it's called by the event-loop
+type streamSink interface {
+	// begin a message, the error fails the conn
+	begin(opCode ws.OpCode) error
+	// room returns the payload bytes can be written, the decoding stops until the sink drained if it's not positive
+	room() int
+	// write a part of payload
+	write(p []byte)
+	// end the message
+	end()
+}
+
+func (d *decoder) state() ws.State {
+	state := ws.StateServerSide
+	if d.fragmented {
+		state = state.Set(ws.StateFragmented)
+	}
+	return state
+}
+
+// peekHeader parse the frame header at the front of inbound buffer without consuming it.
+//
+// ok is false if the header has not been completely received.
+func (d *decoder) peekHeader(c gnet.Conn) (h ws.Header, size int, ok bool, err error) {
+	buffered := c.InboundBuffered()
+	if buffered < ws.MinHeaderSize {
+		return h, 0, false, nil
+	}
+
+	b, err := c.Peek(ws.MinHeaderSize)
+	if err != nil {
+		return h, 0, false, err
+	}
+
+	size = ws.MinHeaderSize
+	length := b[1] & 0x7f
+	switch length {
+	case 126:
+		size += 2
+	case 127:
+		size += 8
+	}
+	masked := b[1]&0x80 != 0
+	if masked {
+		size += 4
+	}
+	if buffered < size {
+		return h, 0, false, nil
+	}
+
+	if b, err = c.Peek(size); err != nil {
+		return h, 0, false, err
+	}
+
+	h.Fin = b[0]&0x80 != 0
+	h.Rsv = (b[0] & 0x70) >> 4
+	h.OpCode = ws.OpCode(b[0] & 0x0f)
+	h.Masked = masked
+
+	switch length {
+	case 126:
+		h.Length = int64(binary.BigEndian.Uint16(b[2:4]))
+	case 127:
+		u := binary.BigEndian.Uint64(b[2:10])
+		if u&(1<<63) != 0 {
+			return h, 0, false, ws.ErrHeaderLengthMSB
+		}
+		h.Length = int64(u)
+	default:
+		h.Length = int64(length)
+	}
+
+	if masked {
+		copy(h.Mask[:], b[size-4:size])
+	}
+
+	return h, size, true, nil
+}
+
+// Decode consume all complete frames in the inbound buffer of c.
+//
+// control frames are returned as soon as they arrive (even in the middle of a fragmented message),
+// data frames are returned after the final fragment has been received.
+// the returned messages are valid until the next Decode,
+// the payload of unfragmented and uncompressed data message is borrowed from payloadPool.
+func (d *decoder) Decode(c gnet.Conn) (messages []message, err error) {
+	clear(d.messages)
+	messages = d.messages[:0]
+	defer func() {
+		d.messages = messages
+	}()
+	for {
+		if d.streaming {
+			ok, err := d.stream(c)
+			if err != nil || !ok {
+				return messages, err
+			}
+		}
+
+		h, size, ok, err := d.peekHeader(c)
+		if err != nil {
+			return messages, err
+		}
+		if !ok {
+			return messages, nil
+		}
+
+		// permessage-deflate only defines the RSV1 of the first frame of data message,
+		// it's left set on the other frames and rejected by CheckHeader
+		if d.decompressor != nil && h.OpCode.IsData() && h.OpCode != ws.OpContinuation {
+			if h, d.compressed, err = wsflate.UnsetBit(h); err != nil {
+				return messages, err
+			}
+		}
+
+		if err = ws.CheckHeader(h, d.state()); err != nil {
+			return messages, err
+		}
+
+		// rejected by the declared length, before the payload received
+		if d.maxSize > 0 && h.OpCode.IsData() && int64(len(d.fragments))+d.size+h.Length > d.maxSize {
+			return messages, ErrMessageTooBig
+		}
+
+		// the compressed messages are inflated as a whole
+		if d.sink != nil && h.OpCode.IsData() && !d.compressed {
+			if _, err = c.Discard(size); err != nil {
+				return messages, err
+			}
+			if err = d.beginFrame(h); err != nil {
+				return messages, err
+			}
+			continue
+		}
+
+		// waiting for the rest of the frame
+		total := int64(size) + h.Length
+		if int64(c.InboundBuffered()) < total {
+			return messages, nil
+		}
+
+		frame, err := c.Peek(int(total))
+		if err != nil {
+			return messages, err
+		}
+
+		// the peeked bytes are reused by the event-loop, copy the payload out
+		var (
+			payload []byte
+			buf     *[]byte
+		)
+		if h.Fin && h.OpCode.IsData() && h.OpCode != ws.OpContinuation && !d.compressed {
+			buf = getPayload(int(h.Length))
+			payload = *buf
+		} else {
+			payload = make([]byte, h.Length)
+		}
+		copy(payload, frame[size:])
+		if h.Masked {
+			ws.Cipher(payload, h.Mask, 0)
+		}
+
+		if _, err = c.Discard(int(total)); err != nil {
+			return messages, err
+		}
+
+		switch {
+		case h.OpCode.IsControl():
+			messages = append(messages, message{OpCode: h.OpCode, Payload: payload})
+		case h.OpCode == ws.OpContinuation:
+			d.fragments = append(d.fragments, payload...)
+			if h.Fin {
+				if payload, err = d.inflate(d.fragments); err != nil {
+					return messages, err
+				}
+				messages = append(messages, message{OpCode: d.opCode, Payload: payload})
+				d.reset()
+			}
+		case h.Fin:
+			if payload, err = d.inflate(payload); err != nil {
+				return messages, err
+			}
+			messages = append(messages, message{OpCode: h.OpCode, Payload: payload, buf: buf})
+		default:
+			// first fragment of message
+			d.fragmented = true
+			d.opCode = h.OpCode
+			d.fragments = payload
+		}
+	}
+}
+
+// beginFrame start streaming the payload of data frame, the header has been consumed
+func (d *decoder) beginFrame(h ws.Header) error {
+	if h.OpCode != ws.OpContinuation {
+		d.opCode = h.OpCode
+		d.size = 0
+		if err := d.sink.begin(h.OpCode); err != nil {
+			return err
+		}
+	}
+	d.fragmented = !h.Fin
+	d.streaming, d.frame = true, h
+	d.remaining, d.offset = h.Length, 0
+	d.size += h.Length
+	return nil
+}
+
+// stream write the payload of streaming frame in the inbound buffer to the sink,
+// returns false if waiting for the rest of payload or the sink is full
+func (d *decoder) stream(c gnet.Conn) (bool, error) {
+	for d.remaining > 0 {
+		n := min(int64(c.InboundBuffered()), d.remaining, int64(d.sink.room()))
+		if n <= 0 {
+			// the rest of payload stays in the inbound buffer
+			return false, nil
+		}
+
+		b, err := c.Peek(int(n))
+		if err != nil {
+			return false, err
+		}
+		p := make([]byte, n)
+		copy(p, b)
+		if d.frame.Masked {
+			ws.Cipher(p, d.frame.Mask, d.offset)
+		}
+		if _, err = c.Discard(int(n)); err != nil {
+			return false, err
+		}
+		d.remaining -= n
+		d.offset += int(n)
+		d.sink.write(p)
+	}
+
+	d.streaming = false
+	if d.frame.Fin {
+		d.sink.end()
+		d.reset()
+	}
+	return true, nil
+}
+
+// inflate the payload of data message if it's compressed
+func (d *decoder) inflate(payload []byte) ([]byte, error) {
+	if !d.compressed {
+		return payload, nil
+	}
+	return d.decompressor.decompress(payload, d.maxSize)
+}
+
+func (d *decoder) reset() {
+	d.fragmented = false
+	d.opCode = 0
+	d.fragments = nil
+	d.size = 0
+}
+
+// handshakeReadWriter feeds a complete handshake request to ws.Upgrader
+// and writes the response back to the conn
+type handshakeReadWriter struct {
+	io.Reader
+	io.Writer
+}
+
+// peekHandshake returns the handshake request at the front of inbound buffer without consuming it.
+//
+// ok is false if the handshake request has not been completely received.
+func peekHandshake(c gnet.Conn) (request []byte, ok bool) {
+	buf, err := c.Peek(c.InboundBuffered())
+	if err != nil {
+		return nil, false
+	}
+	end := bytes.Index(buf, headerTerminator)
+	if end == -1 {
+		return buf, false
+	}
+	return buf[:end+len(headerTerminator)], true
+}
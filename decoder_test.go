@@ -0,0 +1,241 @@
+package peregrine
+
+import (
+	"bytes"
+	"compress/flate"
+	"github.com/gobwas/ws"
+	"github.com/panjf2000/gnet/v2"
+	"io"
+	"net"
+	"testing"
+)
+
+// mockConn is a gnet.Conn which inbound buffer is fed manually,
+// the asynchronous writes are applied immediately
+type mockConn struct {
+	gnet.Conn
+	inbound  bytes.Buffer
+	outbound bytes.Buffer
+	ctx      any
+	closed   bool
+	// buffered simulate the outbound buffer not flushed
+	buffered int
+	// remote the remote address, 127.0.0.1:10000 if nil
+	remote net.Addr
+	// woken receive the Wake calls
+	woken chan struct{}
+}
+
+func (c *mockConn) OutboundBuffered() int { return c.buffered }
+
+func (c *mockConn) Context() any { return c.ctx }
+
+func (c *mockConn) SetContext(ctx any) { c.ctx = ctx }
+
+func (c *mockConn) Write(p []byte) (int, error) { return c.outbound.Write(p) }
+
+func (c *mockConn) AsyncWrite(p []byte, callback gnet.AsyncCallback) error {
+	_, err := c.outbound.Write(p)
+	if callback != nil {
+		return callback(c, err)
+	}
+	return err
+}
+
+func (c *mockConn) Writev(bs [][]byte) (int, error) {
+	n := 0
+	for _, b := range bs {
+		m, _ := c.outbound.Write(b)
+		n += m
+	}
+	return n, nil
+}
+
+func (c *mockConn) AsyncWritev(bs [][]byte, callback gnet.AsyncCallback) error {
+	_, err := c.Writev(bs)
+	if callback != nil {
+		return callback(c, err)
+	}
+	return err
+}
+
+func (c *mockConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func (c *mockConn) RemoteAddr() net.Addr {
+	if c.remote != nil {
+		return c.remote
+	}
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10000}
+}
+
+func (c *mockConn) Wake(_ gnet.AsyncCallback) error {
+	if c.woken != nil {
+		c.woken <- struct{}{}
+	}
+	return nil
+}
+
+func (c *mockConn) InboundBuffered() int { return c.inbound.Len() }
+
+func (c *mockConn) Peek(n int) ([]byte, error) {
+	if n > c.inbound.Len() {
+		return nil, io.ErrShortBuffer
+	}
+	if n <= 0 {
+		n = c.inbound.Len()
+	}
+	return c.inbound.Bytes()[:n], nil
+}
+
+func (c *mockConn) Discard(n int) (int, error) {
+	c.inbound.Next(n)
+	return n, nil
+}
+
+func compileClientFrame(t testing.TB, frame ws.Frame) []byte {
+	b, err := ws.CompileFrame(ws.MaskFrame(frame))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestDecoder_PartialFrame(t *testing.T) {
+	var (
+		c       = &mockConn{}
+		d       = &decoder{}
+		payload = bytes.Repeat([]byte("peregrine"), 1024)
+		frame   = compileClientFrame(t, ws.NewBinaryFrame(payload))
+	)
+
+	// feed the frame byte by byte
+	for i := 0; i < len(frame)-1; i++ {
+		c.inbound.WriteByte(frame[i])
+		messages, err := d.Decode(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(messages) != 0 {
+			t.Fatalf("unexpected message at offset %d", i)
+		}
+	}
+
+	c.inbound.WriteByte(frame[len(frame)-1])
+	messages, err := d.Decode(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 || messages[0].OpCode != ws.OpBinary || !bytes.Equal(messages[0].Payload, payload) {
+		t.Fatalf("unexpected messages: %v", messages)
+	}
+	if c.InboundBuffered() != 0 {
+		t.Fatalf("inbound buffer not consumed, remaining: %d", c.InboundBuffered())
+	}
+}
+
+func TestDecoder_Fragmented(t *testing.T) {
+	var (
+		c = &mockConn{}
+		d = &decoder{}
+	)
+
+	c.inbound.Write(compileClientFrame(t, ws.NewFrame(ws.OpText, false, []byte("hello "))))
+	c.inbound.Write(compileClientFrame(t, ws.NewPingFrame([]byte("ping"))))
+	c.inbound.Write(compileClientFrame(t, ws.NewFrame(ws.OpContinuation, false, []byte("peregrine"))))
+
+	messages, err := d.Decode(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 || messages[0].OpCode != ws.OpPing {
+		t.Fatalf("expect a ping message in the middle of fragmented message, got: %v", messages)
+	}
+
+	// half of the final fragment
+	final := compileClientFrame(t, ws.NewFrame(ws.OpContinuation, true, []byte("!")))
+	c.inbound.Write(final[:3])
+	if messages, err = d.Decode(c); err != nil || len(messages) != 0 {
+		t.Fatalf("unexpected decode result: %v, %v", messages, err)
+	}
+
+	c.inbound.Write(final[3:])
+	if messages, err = d.Decode(c); err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 || messages[0].OpCode != ws.OpText || string(messages[0].Payload) != "hello peregrine!" {
+		t.Fatalf("unexpected messages: %v", messages)
+	}
+}
+
+func TestDecoder_UnexpectedContinuation(t *testing.T) {
+	c := &mockConn{}
+	c.inbound.Write(compileClientFrame(t, ws.NewFrame(ws.OpContinuation, true, []byte("peregrine"))))
+
+	if _, err := (&decoder{}).Decode(c); err != ws.ErrProtocolContinuationUnexpected {
+		t.Fatalf("expect %v, got: %v", ws.ErrProtocolContinuationUnexpected, err)
+	}
+}
+
+func TestDecoder_MaxSize(t *testing.T) {
+	const maxSize = 1024
+
+	// the header of a 2GB frame, the payload never arrives
+	c := &mockConn{}
+	header := ws.Header{Fin: true, OpCode: ws.OpBinary, Length: 2 << 30, Masked: true}
+	if err := ws.WriteHeader(&c.inbound, header); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (&decoder{maxSize: maxSize}).Decode(c); err != ErrMessageTooBig {
+		t.Fatalf("expect %v, got: %v", ErrMessageTooBig, err)
+	}
+
+	// the fragments grow past the limit
+	var (
+		d        = &decoder{maxSize: maxSize}
+		fragment = bytes.Repeat([]byte("p"), maxSize/2)
+	)
+	c = &mockConn{}
+	c.inbound.Write(compileClientFrame(t, ws.NewFrame(ws.OpText, false, fragment)))
+	c.inbound.Write(compileClientFrame(t, ws.NewFrame(ws.OpContinuation, false, fragment)))
+	c.inbound.Write(compileClientFrame(t, ws.NewFrame(ws.OpContinuation, true, []byte("!"))))
+	if _, err := d.Decode(c); err != ErrMessageTooBig {
+		t.Fatalf("expect %v, got: %v", ErrMessageTooBig, err)
+	}
+
+	// the compressed message inflated past the limit
+	frame, err := newCompressor(flate.BestCompression, 0, false, 0).frame(ws.OpBinary, make([]byte, 64*maxSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frame.Payload) > maxSize {
+		t.Fatalf("compressed payload too large: %d", len(frame.Payload))
+	}
+	c = &mockConn{}
+	c.inbound.Write(compileClientFrame(t, frame))
+	if _, err = (&decoder{maxSize: maxSize, decompressor: newDecompressor(false)}).Decode(c); err != ErrMessageTooBig {
+		t.Fatalf("expect %v, got: %v", ErrMessageTooBig, err)
+	}
+}
+
+func TestServer_MaxMessageSize(t *testing.T) {
+	s := NewServer("tcp://127.0.0.1:0", WithMaxMessageSize(1024))
+	c, _ := upgradeMockConn(t, s)
+
+	if err := ws.WriteHeader(&c.inbound, ws.Header{Fin: true, OpCode: ws.OpBinary, Length: 2 << 30, Masked: true}); err != nil {
+		t.Fatal(err)
+	}
+	if action := s.OnTraffic(c); action != gnet.Close {
+		t.Fatalf("conn not closed, action: %v", action)
+	}
+
+	frame, err := ws.ReadFrame(&c.outbound)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := ws.ParseCloseFrameData(frame.Payload); frame.Header.OpCode != ws.OpClose || code != ws.StatusMessageTooBig {
+		t.Fatalf("unexpected close frame: %v", frame)
+	}
+}
@@ -0,0 +1,133 @@
+package peregrine
+
+import (
+	"github.com/panjf2000/gnet/v2"
+	"sync"
+)
+
+type DispatchMode uint8
+
+const (
+	// DispatchConcurrent submit every message to the worker pool on its own,
+	// messages from the same Conn may be handled out of order or at the same time
+	DispatchConcurrent DispatchMode = iota
+
+	// DispatchOrdered handle the messages from the same Conn one at a time in FIFO order,
+	// messages from different Conn are still handled in parallel
+	DispatchOrdered
+)
+
+// mailbox is a per-Conn FIFO task queue, drained by one worker pool task at a time
+type mailbox struct {
+	mu    sync.Mutex
+	tasks []func()
+	// head the index of the next task, the drained tasks are kept to reuse the underlying array
+	head    int
+	running bool
+	// drainTask the cached drain, only accessed by the event-loop
+	drainTask func()
+}
+
+// push appends task to the mailbox, reports whether the caller should start draining
+func (m *mailbox) push(task func()) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.head > 0 && len(m.tasks) == cap(m.tasks) {
+		// compact the drained tasks before growing
+		n := copy(m.tasks, m.tasks[m.head:])
+		clear(m.tasks[n:])
+		m.tasks, m.head = m.tasks[:n], 0
+	}
+	m.tasks = append(m.tasks, task)
+	if m.running {
+		return false
+	}
+	m.running = true
+	return true
+}
+
+// abort revert the last push which failed to start draining
+func (m *mailbox) abort() {
+	m.mu.Lock()
+	m.tasks[len(m.tasks)-1] = nil
+	m.tasks = m.tasks[:len(m.tasks)-1]
+	m.running = false
+	m.mu.Unlock()
+}
+
+func (m *mailbox) next() (func(), bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.head == len(m.tasks) {
+		m.running = false
+		// reuse the underlying array
+		m.tasks, m.head = m.tasks[:0], 0
+		return nil, false
+	}
+
+	task := m.tasks[m.head]
+	m.tasks[m.head] = nil
+	m.head++
+	return task, true
+}
+
+// drainer returns drain as a task without allocating a method value every time
+func (m *mailbox) drainer() func() {
+	if m.drainTask == nil {
+		m.drainTask = m.drain
+	}
+	return m.drainTask
+}
+
+// drain runs the tasks in the mailbox until it's empty
+func (m *mailbox) drain() {
+	defer func() {
+		if r := recover(); r != nil {
+			// the rest of tasks will be drained by the next push
+			m.mu.Lock()
+			m.running = false
+			m.mu.Unlock()
+			panic(r)
+		}
+	}()
+
+	for {
+		task, ok := m.next()
+		if !ok {
+			return
+		}
+		task()
+	}
+}
+
+// dispatch submit task of packet to the worker pool according to the dispatch mode,
+// the overload policy is applied if the worker pool rejected it
+func (s *Server) dispatch(packet *Packet, handle func()) gnet.Action {
+	action, _ := s.submit(packet, func() {
+		defer s.inflight.Add(-1)
+		handle()
+	})
+	return action
+}
+
+// submit is dispatch reports whether the task is dropped by the overload policy,
+// the task must decrease the in-flight count once done
+func (s *Server) submit(packet *Packet, task func()) (gnet.Action, bool) {
+	// count the in-flight tasks, Shutdown waits for them
+	s.inflight.Add(1)
+
+	if s.dispatchMode == DispatchOrdered {
+		if !packet.Conn.mailbox.push(task) {
+			// already draining
+			return gnet.None, false
+		}
+		task = packet.Conn.mailbox.drainer()
+	}
+
+	if err := s.workerPool.Submit(task); err != nil {
+		return s.overload(packet, task, err)
+	}
+	return gnet.None, false
+}
@@ -0,0 +1,188 @@
+package peregrine
+
+import (
+	"context"
+	"github.com/gobwas/ws"
+	"github.com/panjf2000/ants/v2"
+	"github.com/panjf2000/gnet/v2"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestServer_DispatchOrdered(t *testing.T) {
+	const (
+		conns    = 8
+		messages = 1000
+	)
+
+	s := NewServer("tcp://127.0.0.1:0", WithDispatchMode(DispatchOrdered))
+
+	wg := sync.WaitGroup{}
+	wg.Add(conns * messages)
+	for i := 0; i < conns; i++ {
+		var (
+			conn     = &Conn{}
+			expected = 0
+			running  atomic.Int32
+		)
+		for seq := 0; seq < messages; seq++ {
+			seq := seq
+			if action := s.dispatch(&Packet{Conn: conn}, func() {
+				defer wg.Done()
+				if running.Add(1) != 1 {
+					t.Error("messages of the same conn are handled at the same time")
+				}
+				if seq != expected {
+					t.Errorf("out of order, expect: %d, got: %d", expected, seq)
+				}
+				expected++
+				running.Add(-1)
+			}); action != gnet.None {
+				t.Fatalf("unexpected action: %v", action)
+			}
+		}
+	}
+	wg.Wait()
+}
+
+// newSaturatedServer returns a server which worker pool has a single worker blocked until release called
+func newSaturatedServer(t *testing.T, opts ...OptionFunc) (s *Server, release func()) {
+	s = NewServer("tcp://127.0.0.1:0", append([]OptionFunc{
+		WithWorkerPool(1, ants.Options{Nonblocking: true}),
+	}, opts...)...)
+
+	block := make(chan struct{})
+	if err := s.workerPool.Submit(func() { <-block }); err != nil {
+		t.Fatal(err)
+	}
+	return s, func() { close(block) }
+}
+
+func TestServer_OverloadDrop(t *testing.T) {
+	s, release := newSaturatedServer(t)
+	defer release()
+
+	if action := s.dispatch(&Packet{Conn: NewUpgraderConn(&mockConn{})}, func() {}); action != gnet.None {
+		t.Fatalf("unexpected action: %v", action)
+	}
+	if s.DroppedMessages() != 1 {
+		t.Fatalf("expect 1 dropped message, got: %d", s.DroppedMessages())
+	}
+}
+
+func TestServer_OverloadQueue(t *testing.T) {
+	s, release := newSaturatedServer(t, WithOverloadPolicy(OverloadQueue), WithOverloadQueueSize(1))
+	s.startOverloadQueue()
+
+	done := make(chan struct{})
+	s.dispatch(&Packet{Conn: NewUpgraderConn(&mockConn{})}, func() { close(done) })
+	// queue is full
+	s.dispatch(&Packet{Conn: NewUpgraderConn(&mockConn{})}, func() {})
+
+	if s.QueuedMessages() != 1 || s.DroppedMessages() != 1 {
+		t.Fatalf("expect 1 queued and 1 dropped message, got: %d, %d", s.QueuedMessages(), s.DroppedMessages())
+	}
+
+	release()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("queued message not handled")
+	}
+}
+
+func TestServer_OverloadQueueStopped(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s, release := newSaturatedServer(t,
+		WithContext(ctx),
+		WithOverloadPolicy(OverloadQueue),
+		WithDispatchMode(DispatchOrdered),
+	)
+	defer release()
+
+	done := make(chan struct{})
+	packet := &Packet{Conn: NewUpgraderConn(&mockConn{})}
+	s.dispatch(packet, func() { close(done) })
+
+	// the tasks left in the queue are run once the server context done
+	s.startOverloadQueue()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("queued message not handled")
+	}
+	stopped := func() bool {
+		s.queueMu.RLock()
+		defer s.queueMu.RUnlock()
+		return s.queueClosed && s.inflight.Load() == 0
+	}
+	for deadline := time.Now().Add(time.Second); !stopped() && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	packet.Conn.mailbox.mu.Lock()
+	running := packet.Conn.mailbox.running
+	packet.Conn.mailbox.mu.Unlock()
+	if !stopped() || running {
+		t.Fatalf("queued message not settled, in-flight: %d", s.inflight.Load())
+	}
+
+	// the queue is stopped
+	s.dispatch(&Packet{Conn: NewUpgraderConn(&mockConn{})}, func() {})
+	if s.DroppedMessages() != 1 || s.inflight.Load() != 0 {
+		t.Fatalf("expect 1 dropped message, got: %d", s.DroppedMessages())
+	}
+}
+
+func TestServer_OverloadHandler(t *testing.T) {
+	var dropped *Packet
+	s, release := newSaturatedServer(t,
+		WithOverloadPolicy(OverloadHandler),
+		WithDispatchMode(DispatchOrdered),
+		WithOnOverloadHandler(func(_ *Conn, packet *Packet) { dropped = packet }),
+	)
+	defer release()
+
+	packet := &Packet{Conn: NewUpgraderConn(&mockConn{})}
+	s.dispatch(packet, func() {})
+	if dropped != packet {
+		t.Fatal("overload handler not called")
+	}
+	if len(packet.Conn.mailbox.tasks) != 0 || packet.Conn.mailbox.running {
+		t.Fatal("dropped message left in the mailbox")
+	}
+}
+
+func TestServer_OverloadReplyClose(t *testing.T) {
+	s, release := newSaturatedServer(t, WithStrictProtocol(), WithDispatchMode(DispatchOrdered))
+	defer release()
+
+	// the close frame of peer is echoed even if the worker pool is saturated
+	c := &mockConn{}
+	conn := NewUpgraderConn(c)
+	if action := s.echoClose(conn, ws.NewCloseFrameBody(ws.StatusGoingAway, "")); action != gnet.None {
+		t.Fatalf("unexpected action: %v", action)
+	}
+	frames := readFrames(t, c)
+	if len(frames) != 1 || frames[0].Header.OpCode != ws.OpClose || !c.closed {
+		t.Fatalf("close frame not echoed: %v", frames)
+	}
+	if code, _ := ws.ParseCloseFrameData(frames[0].Payload); code != ws.StatusGoingAway || s.DroppedMessages() != 0 {
+		t.Fatalf("unexpected close code: %d", code)
+	}
+
+	// queued behind the running handlers of conn
+	c = &mockConn{}
+	conn = NewUpgraderConn(c)
+	conn.mailbox.push(func() {})
+	s.echoClose(conn, nil)
+	if c.outbound.Len() != 0 {
+		t.Fatal("close frame written before the handlers returned")
+	}
+	conn.mailbox.drain()
+	if frames = readFrames(t, c); len(frames) != 1 || frames[0].Header.OpCode != ws.OpClose {
+		t.Fatalf("close frame not echoed: %v", frames)
+	}
+}
@@ -1,14 +1,17 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/RealFax/peregrine"
+	"github.com/RealFax/peregrine/hub"
 	"github.com/RealFax/peregrine/proto"
+	"github.com/gobwas/ws"
 	"github.com/panjf2000/gnet/v2"
 	"os"
 	"os/signal"
-	"sync"
+	"strconv"
 	"syscall"
 	"time"
 )
@@ -21,6 +24,7 @@ const (
 	ProtoSendMessage
 
 	ProtoRecvMessage = iota - ProtoSendMessage + 1000
+	ProtoOnline
 )
 
 type Proto struct {
@@ -36,88 +40,55 @@ func (p *Proto) Value() Proto   { return *p }
 func (p *Proto) Self() *Proto   { return p }
 
 type service struct {
-	room   sync.Map // map[RoomID]*map[ConnID]struct{}
-	online sync.Map // map[ConnID]chan *Proto
+	server *peregrine.Server
+	hub    *hub.Hub
 }
 
-func (s *service) offline(connID string) {
-	s.room.Range(func(_, value any) bool {
-		value.(*sync.Map).Delete(connID)
-		return false
-	})
-
-	ch, ok := s.online.LoadAndDelete(connID)
-	if !ok {
-		return
-	}
-	close(ch.(chan *Proto))
-}
-
-func (s *service) pushback(roomID uint32, source, msg, sign string) {
-	room, ok := s.room.Load(roomID)
-	if !ok {
-		return
-	}
-
-	room.(*sync.Map).Range(func(key, _ any) bool {
-		if source == key {
-			return false
-		}
-
-		ch, cok := s.online.Load(key)
-		if !cok {
-			return false
-		}
-		ch.(chan *Proto) <- &Proto{
-			Type:      ProtoRecvMessage,
-			RoomID:    roomID,
-			Timestamp: time.Now().Unix(),
-			Message:   msg,
-			Signature: sign,
-		}
-		return false
-	})
+func roomTopic(roomID uint32) string {
+	return strconv.FormatUint(uint64(roomID), 10)
 }
 
 func (s *service) joinRoom(req *proto.Request[Proto]) {
-	_, ok := s.online.Load(req.Conn.ID)
-	if !ok {
-		ch := make(chan *Proto, 4)
-		s.online.Store(req.Conn.ID, ch)
-
-		// listen message channel with send
-		go func() {
-			for {
-				msg, ok := <-ch
-				if !ok {
-					return
-				}
-				go func() {
-					b, _ := json.Marshal(msg)
-					req.WriteText(b)
-				}()
-			}
-		}()
-	}
-
-	room, ok := s.room.Load(req.Request.RoomID)
-	if !ok {
-		room = &sync.Map{}
-		s.room.Store(req.Request.RoomID, room)
-	}
-	room.(*sync.Map).Store(req.Conn.ID, struct{}{})
+	s.hub.Join(roomTopic(req.Request.RoomID), req.Conn)
 }
 
 func (s *service) quitRoom(req *proto.Request[Proto]) {
-	room, ok := s.room.Load(req.Request.RoomID)
-	if !ok {
-		return
-	}
-	room.(*sync.Map).Delete(req.Conn.ID)
+	s.hub.Leave(roomTopic(req.Request.RoomID), req.Conn)
 }
 
 func (s *service) sendMessage(req *proto.Request[Proto]) {
-	s.pushback(req.Request.RoomID, req.Conn.ID, req.Request.Message, req.Request.Signature)
+	b, _ := json.Marshal(&Proto{
+		Type:      ProtoRecvMessage,
+		RoomID:    req.Request.RoomID,
+		Timestamp: time.Now().Unix(),
+		Message:   req.Request.Message,
+		Signature: req.Request.Signature,
+	})
+
+	// the message is encoded once and pushed to the other members of room
+	s.hub.Publish(roomTopic(req.Request.RoomID), ws.OpText, b, func(conn *peregrine.Conn) bool {
+		return conn != req.Conn
+	})
+}
+
+// pushOnline write the count of online conns to conn periodically, it returns once the conn closed
+func (s *service) pushOnline(conn *peregrine.Conn) {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-conn.Context().Done():
+			return
+		case <-ticker.C:
+			b, _ := json.Marshal(&Proto{
+				Type:      ProtoOnline,
+				Timestamp: time.Now().Unix(),
+				Message:   strconv.Itoa(s.server.Len()),
+			})
+			_ = conn.WriteText(b)
+		}
+	}
 }
 
 func main() {
@@ -132,19 +103,22 @@ func main() {
 	})
 
 	s := &service{}
-
-	engine.Register(ProtoJoinRoom, s.joinRoom)
-	engine.Register(ProtoQuitRoom, s.quitRoom)
-	engine.Register(ProtoSendMessage, s.sendMessage)
-
 	server := peregrine.NewServer(
 		"tcp://127.0.0.1:8080",
 		peregrine.WithHandler(engine.UseHandler()),
-		peregrine.WithOnCloseHandler(func(conn *peregrine.Conn, _ error) {
-			s.offline(conn.ID)
+		peregrine.WithOnOpenHandler(func(conn *peregrine.Conn) error {
+			go s.pushOnline(conn)
+			return nil
 		}),
 	)
 
+	// the conns leave all rooms automatically once closed
+	s.server, s.hub = server, hub.New(server)
+
+	engine.Register(ProtoJoinRoom, s.joinRoom)
+	engine.Register(ProtoQuitRoom, s.quitRoom)
+	engine.Register(ProtoSendMessage, s.sendMessage)
+
 	go func() {
 		if err := server.ListenAndServe(gnet.WithMulticore(true)); err != nil {
 			fmt.Println("[-] gnet error:", err)
@@ -154,5 +128,11 @@ func main() {
 	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, syscall.SIGTERM, syscall.SIGINT)
 	<-ch
-	// server.Stop(context.Background())
+
+	// write close frames to the conns and wait for the in-flight messages
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		fmt.Println("[-] shutdown error:", err)
+	}
 }
@@ -3,6 +3,7 @@ module github.com/RealFax/peregrine
 go 1.21
 
 require (
+	github.com/gobwas/httphead v0.1.0
 	github.com/gobwas/ws v1.3.0
 	github.com/google/uuid v1.6.0
 	github.com/jellydator/ttlcache/v3 v3.2.0
@@ -14,7 +15,6 @@ require (
 replace github.com/gobwas/ws v1.3.0 => github.com/RealFax/ws v0.3.0
 
 require (
-	github.com/gobwas/httphead v0.1.0 // indirect
 	github.com/gobwas/pool v0.2.1 // indirect
 	github.com/valyala/bytebufferpool v1.0.0 // indirect
 	go.uber.org/multierr v1.11.0 // indirect
@@ -0,0 +1,139 @@
+package peregrine_test
+
+import (
+	"bufio"
+	"context"
+	"github.com/RealFax/peregrine"
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/panjf2000/gnet/v2"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestServer_Shutdown(t *testing.T) {
+	var (
+		started = make(chan struct{})
+		handled atomic.Bool
+	)
+
+	server := peregrine.NewServer(
+		"tcp://127.0.0.1:19211",
+		peregrine.WithHandler(func(_ *peregrine.Packet) {
+			close(started)
+			time.Sleep(200 * time.Millisecond)
+			handled.Store(true)
+		}),
+		peregrine.WithShutdownClose(ws.StatusGoingAway, "bye"),
+	)
+
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- server.ListenAndServe(gnet.WithReuseAddr(true))
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	conn, _, _, err := ws.Dial(context.Background(), "ws://127.0.0.1:19211")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err = wsutil.WriteClientText(conn, []byte("peregrine")); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+		shutdown <- server.Shutdown(ctx)
+	}()
+
+	// the close frame of server
+	frame, err := ws.ReadFrame(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, reason := ws.ParseCloseFrameData(frame.Payload)
+	if frame.Header.OpCode != ws.OpClose || code != ws.StatusGoingAway || reason != "bye" {
+		t.Fatalf("unexpected close frame: %v, %d, %s", frame.Header.OpCode, code, reason)
+	}
+	if err = ws.WriteFrame(conn, ws.MaskFrame(ws.NewCloseFrame(ws.NewCloseFrameBody(code, "")))); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = <-shutdown; err != nil {
+		t.Fatal(err)
+	}
+	if !handled.Load() {
+		t.Fatal("in-flight handler not drained")
+	}
+	if err = <-stopped; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServer_ShutdownHandshake(t *testing.T) {
+	server := peregrine.NewServer("tcp://127.0.0.1:19212")
+	go func() {
+		_ = server.ListenAndServe(gnet.WithReuseAddr(true))
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	// keeps Shutdown waiting until it replies the close frame
+	conn, _, _, err := ws.Dial(context.Background(), "ws://127.0.0.1:19212")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// the conn opened before Shutdown, finishes the handshake after it
+	raw, err := net.Dial("tcp", "127.0.0.1:19212")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	handshake := "GET / HTTP/1.1\r\n" +
+		"Host: 127.0.0.1\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+		"Sec-WebSocket-Version: 13\r\n\r\n"
+	if _, err = raw.Write([]byte(handshake[:16])); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+		shutdown <- server.Shutdown(ctx)
+	}()
+	if frame, err := ws.ReadFrame(conn); err != nil || frame.Header.OpCode != ws.OpClose {
+		t.Fatalf("expect the close frame, got: %v", err)
+	}
+
+	if _, err = raw.Write([]byte(handshake[16:])); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(raw), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expect handshake rejected, got: %s", resp.Status)
+	}
+
+	if err = ws.WriteFrame(conn, ws.MaskFrame(ws.NewCloseFrame(nil))); err != nil {
+		t.Fatal(err)
+	}
+	if err = <-shutdown; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,26 +1,83 @@
 package peregrine
 
 import (
-	"bytes"
 	"github.com/gobwas/ws"
+	"net/http"
+	"sync/atomic"
 )
 
 type (
+	// OnOpenHandlerFunc called on the event-loop after the handshake succeeded, before any message handled.
+	// the conn is closed with the code of CloseError (StatusPolicyViolation for other errors) if returns an error
+	OnOpenHandlerFunc func(conn *Conn) error
+
+	// OnHandshakeHandlerFunc called on the event-loop during the handshake, before the response written.
+	// conn is not upgraded, the Header, Path and Query of conn have been set.
+	// the handshake is rejected if returns an error, the status is set by ws.RejectConnectionError (403 for other errors)
+	OnHandshakeHandlerFunc func(conn *Conn, r *http.Request) error
+
+	// OnUpgradeErrorHandlerFunc called on the event-loop when the handshake failed, conn is not upgraded
+	OnUpgradeErrorHandlerFunc func(conn *Conn, err error)
+
+	// OnCloseHandlerFunc called on the event-loop once the conn closed,
+	// err is the reason of server closing the conn, or the error of the underlying conn
 	OnCloseHandlerFunc func(conn *Conn, err error)
-	OnPingHandlerFunc  func(conn *Conn)
-	HandlerFunc        func(packet *Packet)
 
+	// OnPingHandlerFunc called after the server answered the ping with a pong, it must not write another pong
+	OnPingHandlerFunc func(conn *Conn)
+	OnPongHandlerFunc func(conn *Conn)
+	HandlerFunc       func(packet *Packet)
+
+	// OnOverloadHandlerFunc called on the event-loop with the packet dropped by OverloadHandler policy,
+	// the packet is released once the handler returned, Retain it to keep
+	OnOverloadHandlerFunc func(conn *Conn, packet *Packet)
+
+	// OnRateLimitedHandlerFunc called on the event-loop with the packet exceeded the rate limit of conn,
+	// before the RateLimitPolicy applied. the packet is released once the handler returned, Retain it to keep
+	OnRateLimitedHandlerFunc func(conn *Conn, packet *Packet)
+
+	// OnSlowConsumerHandlerFunc called after the slow consumer policy applied to the conn which outbound buffer
+	// exceeded the limit, buffered the pending outbound bytes. it's called by the event-loop or the writing goroutine
+	OnSlowConsumerHandlerFunc func(conn *Conn, buffered int)
+
+	// Packet is the message passed to HandlerFunc, the packets of data messages are pooled.
+	// Request is only valid until the handler returned, call Retain to keep it longer
 	Packet struct {
 		OpCode  ws.OpCode
 		Request []byte
 		Conn    *Conn
+
+		// pooled set if the packet is borrowed from packetPool, refs the references of it
+		pooled bool
+		refs   atomic.Int32
+		// buf the pooled buffer of Request
+		buf      *[]byte
+		inflight *atomic.Int64
+		// task the cached run of packet
+		task func()
 	}
 )
 
-func EmptyHandler(_ *Packet)               {}
-func EmptyOnCloseHandler(_ *Conn, _ error) {}
-func DefaultOnPingHandler(c *Conn) {
-	buf := &bytes.Buffer{}
-	_ = ws.WriteFrame(buf, ws.NewPongFrame([]byte{}))
-	_ = c.AsyncWrite(buf.Bytes(), nil)
+// CloseError returned by handlers to close the conn with Code
+type CloseError struct {
+	Code   ws.StatusCode
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return e.Reason
 }
+
+func EmptyHandler(_ *Packet)                       {}
+func EmptyOnOpenHandler(_ *Conn) error             { return nil }
+func EmptyOnUpgradeErrorHandler(_ *Conn, _ error)  {}
+func EmptyOnCloseHandler(_ *Conn, _ error)         {}
+func EmptyOnOverloadHandler(_ *Conn, _ *Packet)    {}
+func EmptyOnPongHandler(_ *Conn)                   {}
+func EmptyOnRateLimitedHandler(_ *Conn, _ *Packet) {}
+func EmptyOnSlowConsumerHandler(_ *Conn, _ int)    {}
+
+// DefaultOnPingHandler the pong has been written by the server before the OnPingHandlerFunc called.
+//
+// it wrote an empty pong before the server answered the pings itself, it's a no-op now
+func DefaultOnPingHandler(_ *Conn) {}
@@ -0,0 +1,82 @@
+package peregrine
+
+import (
+	"bufio"
+	"github.com/gobwas/ws"
+	"github.com/panjf2000/gnet/v2"
+	"net/http"
+	"testing"
+)
+
+// readHandshakeResponse read the handshake response written to c, returns the rest of outbound
+func readHandshakeResponse(t testing.TB, c *mockConn) (*http.Response, *bufio.Reader) {
+	r := bufio.NewReader(&c.outbound)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, r
+}
+
+func TestServer_OnOpenHandler(t *testing.T) {
+	s := NewServer("tcp://127.0.0.1:0", WithOnOpenHandler(func(conn *Conn) error {
+		conn.Set("user", "peregrine")
+		return conn.WriteText([]byte("welcome"))
+	}))
+
+	c := &mockConn{}
+	c.inbound.WriteString(testHandshake)
+	if action := s.OnTraffic(c); action != gnet.None {
+		t.Fatalf("unexpected action: %v", action)
+	}
+
+	if user, _ := TryAssertKeys[string](c.Context().(*Conn), "user"); user != "peregrine" {
+		t.Fatal("keys not attached")
+	}
+
+	_, r := readHandshakeResponse(t, c)
+	if frame, err := ws.ReadFrame(r); err != nil || frame.Header.OpCode != ws.OpText || string(frame.Payload) != "welcome" {
+		t.Fatalf("unexpected welcome message: %v, %v", frame, err)
+	}
+}
+
+func TestServer_OnOpenHandler_Reject(t *testing.T) {
+	s := NewServer("tcp://127.0.0.1:0", WithOnOpenHandler(func(_ *Conn) error {
+		return &CloseError{Code: 4001, Reason: "unauthorized"}
+	}))
+
+	c := &mockConn{}
+	c.inbound.WriteString(testHandshake)
+	if action := s.OnTraffic(c); action != gnet.Close {
+		t.Fatalf("expect close, got: %v", action)
+	}
+
+	_, r := readHandshakeResponse(t, c)
+	frame, err := ws.ReadFrame(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, reason := ws.ParseCloseFrameData(frame.Payload)
+	if frame.Header.OpCode != ws.OpClose || code != 4001 || reason != "unauthorized" {
+		t.Fatalf("unexpected close frame: %v, %d, %s", frame.Header.OpCode, code, reason)
+	}
+}
+
+func TestServer_OnUpgradeErrorHandler(t *testing.T) {
+	var upgradeErr error
+	s := NewServer("tcp://127.0.0.1:0", WithOnUpgradeErrorHandler(func(_ *Conn, err error) {
+		upgradeErr = err
+	}))
+
+	c := &mockConn{}
+	c.inbound.WriteString("GET / HTTP/1.1\r\nHost: 127.0.0.1\r\n\r\n")
+	if action := s.OnTraffic(c); action != gnet.Close {
+		t.Fatalf("expect close, got: %v", action)
+	}
+	if upgradeErr == nil {
+		t.Fatal("OnUpgradeErrorHandler not called")
+	}
+	if resp, _ := readHandshakeResponse(t, c); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("unexpected status: %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,33 @@
+package peregrine
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/gobwas/ws"
+	"github.com/pkg/errors"
+	"net/http"
+)
+
+// handshake parse the handshake request and call the OnHandshakeHandlerFunc, it's called before the response written
+func (s *Server) handshake(conn *Conn, request []byte) error {
+	r, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(request)))
+	if err != nil {
+		return ws.RejectConnectionError(
+			ws.RejectionStatus(http.StatusBadRequest),
+			ws.RejectionReason(err.Error()),
+		)
+	}
+	conn.Header = r.Header
+
+	if err = s.onHandshakeHandler(conn, r); err != nil {
+		var rejected *ws.ConnectionRejectedError
+		if errors.As(err, &rejected) {
+			return err
+		}
+		return ws.RejectConnectionError(
+			ws.RejectionStatus(http.StatusForbidden),
+			ws.RejectionReason(err.Error()),
+		)
+	}
+	return nil
+}
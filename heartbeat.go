@@ -0,0 +1,62 @@
+package peregrine
+
+import (
+	"encoding/binary"
+	"github.com/gobwas/ws"
+	"github.com/pkg/errors"
+	"time"
+)
+
+var (
+	ErrPongTimeout = errors.New("pong timeout")
+)
+
+// heartbeat send a ping to conn every ping interval, close the conn if the pong not arrived in pong timeout.
+// returns the deadline of next heartbeat, ok is false if the conn closed.
+//
+// the payload of ping is the unix nano of sent, used to measure the RTT
+func (s *Server) heartbeat(conn *Conn, now time.Time) (deadline time.Time, ok bool) {
+	if sent := conn.pingSentAt.Load(); sent != 0 {
+		// waiting for pong
+		if deadline = time.Unix(0, sent).Add(s.timeouts.pongTimeout); deadline.After(now) {
+			return deadline, true
+		}
+		if err := s.CloseConn(conn, ws.StatusGoingAway, ErrPongTimeout); err != nil {
+			_ = conn.Conn.Close()
+		}
+		return time.Time{}, false
+	}
+
+	last := conn.lastPing.Load()
+	if last == 0 {
+		// the first heartbeat after upgraded
+		conn.lastPing.Store(now.UnixNano())
+		return now.Add(s.timeouts.pingInterval), true
+	}
+	if deadline = time.Unix(0, last).Add(s.timeouts.pingInterval); deadline.After(now) {
+		return deadline, true
+	}
+
+	sent := now.UnixNano()
+	if !conn.pingSentAt.CompareAndSwap(0, sent) {
+		// the ping sent by another check
+		return now.Add(s.timeouts.pongTimeout), true
+	}
+	conn.lastPing.Store(sent)
+
+	payload := make([]byte, 8)
+	binary.BigEndian.PutUint64(payload, uint64(sent))
+	_ = conn.WritePing(payload)
+	return now.Add(s.timeouts.pongTimeout), true
+}
+
+// pong measure the RTT if the pong answers the ping of heartbeat, it's called by the event-loop
+func (s *Server) pong(conn *Conn, payload []byte) {
+	sent := conn.pingSentAt.Load()
+	if sent == 0 || len(payload) != 8 || int64(binary.BigEndian.Uint64(payload)) != sent {
+		return
+	}
+	if conn.pingSentAt.CompareAndSwap(sent, 0) {
+		conn.rtt.Store(s.wheel.now().UnixNano() - sent)
+	}
+}
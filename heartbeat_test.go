@@ -0,0 +1,63 @@
+package peregrine
+
+import (
+	"bufio"
+	"github.com/gobwas/ws"
+	"testing"
+	"time"
+)
+
+// readPing tick the server until a ping written to c
+func readPing(t *testing.T, clock *fakeClock, c *mockConn, r *bufio.Reader) ws.Frame {
+	for end := clock.now.Add(time.Second); c.outbound.Len() == 0; {
+		if !clock.now.Before(end) {
+			t.Fatal("ping not sent")
+		}
+		clock.advance(clock.s.wheel.tick)
+	}
+
+	frame, err := ws.ReadFrame(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frame.Header.OpCode != ws.OpPing {
+		t.Fatalf("expect ping, got: %v", frame.Header.OpCode)
+	}
+	return frame
+}
+
+func TestServer_Heartbeat(t *testing.T) {
+	pong := make(chan struct{}, 1)
+	s := NewServer(
+		"tcp://127.0.0.1:0",
+		WithIdleTimeout(0),
+		WithHeartbeat(20*time.Millisecond, 50*time.Millisecond),
+		WithTimeoutTick(5*time.Millisecond),
+		WithOnPongHandler(func(_ *Conn) { pong <- struct{}{} }),
+	)
+	clock := newFakeClock(s)
+
+	c := &mockConn{}
+	s.OnOpen(c)
+	c.inbound.WriteString(testHandshake)
+	s.OnTraffic(c)
+	conn := c.Context().(*Conn)
+	_, r := readHandshakeResponse(t, c)
+
+	// answer the ping
+	ping := readPing(t, clock, c, r)
+	clock.now = clock.now.Add(time.Millisecond)
+	c.inbound.Write(compileClientFrame(t, ws.NewPongFrame(ping.Payload)))
+	s.OnTraffic(c)
+	<-pong
+	if conn.RTT() != time.Millisecond {
+		t.Fatalf("unexpected RTT: %v", conn.RTT())
+	}
+
+	// ignore the next ping
+	readPing(t, clock, c, r)
+	clock.tickUntil(c, time.Second)
+	if err := conn.closeReason(nil); !c.closed || err != ErrPongTimeout {
+		t.Fatalf("expect closed by %v, got: %v", ErrPongTimeout, err)
+	}
+}
@@ -0,0 +1,52 @@
+package hub
+
+import (
+	"github.com/gobwas/ws"
+	"sync"
+)
+
+// Message is a topic message relayed between the hubs of different nodes
+type Message struct {
+	// Node the id of hub which published the message
+	Node    string
+	Topic   string
+	OpCode  ws.OpCode
+	Payload []byte
+}
+
+// Broker relay the messages published by a hub to the hubs of other nodes
+type Broker interface {
+	// Publish relay msg to the other nodes, msg must not be modified after called
+	Publish(msg *Message) error
+
+	// Subscribe register the handler called with the messages relayed by broker,
+	// the messages published by the hub itself may also be delivered
+	Subscribe(handler func(msg *Message))
+}
+
+// MemoryBroker is an in-process Broker, the hubs share the same MemoryBroker
+type MemoryBroker struct {
+	rwm      sync.RWMutex
+	handlers []func(msg *Message)
+}
+
+func (b *MemoryBroker) Publish(msg *Message) error {
+	b.rwm.RLock()
+	handlers := b.handlers
+	b.rwm.RUnlock()
+
+	for _, handler := range handlers {
+		handler(msg)
+	}
+	return nil
+}
+
+func (b *MemoryBroker) Subscribe(handler func(msg *Message)) {
+	b.rwm.Lock()
+	b.handlers = append(b.handlers[:len(b.handlers):len(b.handlers)], handler)
+	b.rwm.Unlock()
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{}
+}
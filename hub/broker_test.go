@@ -0,0 +1,139 @@
+package hub_test
+
+import (
+	"github.com/RealFax/peregrine"
+	"github.com/RealFax/peregrine/hub"
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/pkg/errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testRelay publish a message on the first node and expect it's received by the member of second node
+func testRelay(t *testing.T, b1, b2 hub.Broker) {
+	var (
+		s1 = peregrine.NewServer("tcp://127.0.0.1:0")
+		s2 = peregrine.NewServer("tcp://127.0.0.1:0")
+		h1 = hub.New(s1, hub.WithBroker(b1))
+		h2 = hub.New(s2, hub.WithBroker(b2))
+
+		c1, conn1 = upgrade(t, s1)
+		c2, conn2 = upgrade(t, s2)
+	)
+
+	h1.Join("lobby", conn1)
+	h2.Join("lobby", conn2)
+
+	if _, err := h1.Publish("lobby", ws.OpText, []byte("peregrine"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// the message written by another goroutine in TCPBroker
+	deadline := time.Now().Add(3 * time.Second)
+	for c2.Len() == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	for _, c := range []*fakeConn{c1, c2} {
+		outbound := c.Outbound()
+		if message, err := wsutil.ReadServerText(outbound); err != nil || string(message) != "peregrine" {
+			t.Fatalf("unexpected message: %s, %v", message, err)
+		}
+		// published once on each node
+		if outbound.Len() != 0 {
+			t.Fatal("message duplicated")
+		}
+	}
+}
+
+func TestMemoryBroker(t *testing.T) {
+	b := hub.NewMemoryBroker()
+	testRelay(t, b, b)
+}
+
+func TestTCPBroker(t *testing.T) {
+	b1, err := hub.ListenTCPBroker("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b1.Close()
+
+	b2, err := hub.ListenTCPBroker("127.0.0.1:0", b1.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b2.Close()
+	b1.AddPeer(b2.Addr().String())
+
+	testRelay(t, b1, b2)
+}
+
+func TestTCPBroker_StalledPeer(t *testing.T) {
+	// the peer accepts but never reads
+	stalled, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stalled.Close()
+
+	b, err := hub.ListenTCPBroker("127.0.0.1:0", stalled.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Publish never blocks on the peer, the messages over backlog are dropped
+	var (
+		msg     = &hub.Message{Topic: "lobby", OpCode: ws.OpBinary, Payload: make([]byte, 64<<10)}
+		start   = time.Now()
+		backlog bool
+	)
+	for i := 0; i < 1536; i++ {
+		if err = b.Publish(msg); errors.Is(err, hub.ErrPeerBacklog) {
+			backlog = true
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second || !backlog {
+		t.Fatalf("publish blocked by the stalled peer: %v, backlog: %v", elapsed, backlog)
+	}
+
+	start = time.Now()
+	_ = b.Close()
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("close blocked by the stalled peer: %v", elapsed)
+	}
+}
+
+func TestTCPBroker_InvalidOpCode(t *testing.T) {
+	b, err := hub.ListenTCPBroker("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	var relayed atomic.Bool
+	b.Subscribe(func(*hub.Message) { relayed.Store(true) })
+
+	conn, err := net.Dial("tcp", b.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// | length | opcode (ping) | node length | topic length |
+	if _, err = conn.Write([]byte{0, 0, 0, 4, byte(ws.OpPing), 0, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err = conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expect the conn closed, got: %v", err)
+	}
+	if relayed.Load() {
+		t.Fatal("control message relayed")
+	}
+}
@@ -0,0 +1,180 @@
+package hub
+
+import (
+	"github.com/RealFax/peregrine"
+	"github.com/gobwas/ws"
+	"github.com/google/uuid"
+	"sync"
+)
+
+// Hub is a set of named topics, the conns subscribe to topics and receive the messages published to them.
+//
+// the members are tracked by Conn.ID and looked up in the server's registry,
+// a conn leaves all topics automatically once it closed.
+//
+// with a Broker, the messages are relayed to the hubs of other nodes
+type Hub struct {
+	server *peregrine.Server
+	broker Broker
+	// node the id of hub, used to ignore the messages published by itself
+	node string
+
+	rwm    sync.RWMutex
+	topics map[string]map[string]struct{} // map[Topic]map[ConnID]struct{}
+	joined map[string]map[string]struct{} // map[ConnID]map[Topic]struct{}
+}
+
+// Join subscribe conn to topic, it's ignored if conn already closed
+func (h *Hub) Join(topic string, conn *peregrine.Conn) {
+	h.rwm.Lock()
+	defer h.rwm.Unlock()
+
+	// the context is canceled before the conn leaves all topics on close
+	if conn.Context().Err() != nil {
+		return
+	}
+	add(h.topics, topic, conn.ID)
+	add(h.joined, conn.ID, topic)
+}
+
+// Leave unsubscribe conn from topic
+func (h *Hub) Leave(topic string, conn *peregrine.Conn) {
+	h.rwm.Lock()
+	defer h.rwm.Unlock()
+
+	remove(h.topics, topic, conn.ID)
+	remove(h.joined, conn.ID, topic)
+}
+
+// LeaveAll unsubscribe conn from all topics
+func (h *Hub) LeaveAll(conn *peregrine.Conn) {
+	h.leaveAll(conn.ID)
+}
+
+func (h *Hub) leaveAll(id string) {
+	h.rwm.Lock()
+	defer h.rwm.Unlock()
+
+	for topic := range h.joined[id] {
+		remove(h.topics, topic, id)
+	}
+	delete(h.joined, id)
+}
+
+// Publish write a message to the members of topic which filter (could be nil) returns true,
+// returns the count of local conns the message is written to.
+//
+// the message is encoded once and shared by all members.
+// with a Broker, the message is also relayed to other nodes, filter only applies to the local members
+func (h *Hub) Publish(topic string, opCode ws.OpCode, p []byte, filter func(conn *peregrine.Conn) bool) (int, error) {
+	count := h.publish(topic, peregrine.NewPreparedMessage(opCode, p), filter)
+	if h.broker == nil {
+		return count, nil
+	}
+	return count, h.broker.Publish(&Message{
+		Node:    h.node,
+		Topic:   topic,
+		OpCode:  opCode,
+		Payload: p,
+	})
+}
+
+// relay publish the message relayed by broker to the local members
+func (h *Hub) relay(msg *Message) {
+	if msg.Node == h.node {
+		return
+	}
+	h.publish(msg.Topic, peregrine.NewPreparedMessage(msg.OpCode, msg.Payload), nil)
+}
+
+func (h *Hub) publish(topic string, pm *peregrine.PreparedMessage, filter func(conn *peregrine.Conn) bool) int {
+	count := 0
+	for _, id := range h.Members(topic) {
+		conn, ok := h.server.Conn(id)
+		if !ok || (filter != nil && !filter(conn)) {
+			continue
+		}
+		if conn.WritePreparedMessage(pm) == nil {
+			count++
+		}
+	}
+	return count
+}
+
+// Members returns the Conn.ID of the members of topic
+func (h *Hub) Members(topic string) []string {
+	h.rwm.RLock()
+	defer h.rwm.RUnlock()
+	return keys(h.topics[topic])
+}
+
+// Count returns the count of the members of topic
+func (h *Hub) Count(topic string) int {
+	h.rwm.RLock()
+	defer h.rwm.RUnlock()
+	return len(h.topics[topic])
+}
+
+// Topics returns the topics which conn joined
+func (h *Hub) Topics(conn *peregrine.Conn) []string {
+	h.rwm.RLock()
+	defer h.rwm.RUnlock()
+	return keys(h.joined[conn.ID])
+}
+
+// Joined reports whether conn is a member of topic
+func (h *Hub) Joined(topic string, conn *peregrine.Conn) bool {
+	h.rwm.RLock()
+	defer h.rwm.RUnlock()
+	_, found := h.topics[topic][conn.ID]
+	return found
+}
+
+func add(m map[string]map[string]struct{}, key, value string) {
+	set, ok := m[key]
+	if !ok {
+		set = make(map[string]struct{})
+		m[key] = set
+	}
+	set[value] = struct{}{}
+}
+
+func remove(m map[string]map[string]struct{}, key, value string) {
+	set, ok := m[key]
+	if !ok {
+		return
+	}
+	delete(set, value)
+	if len(set) == 0 {
+		delete(m, key)
+	}
+}
+
+func keys(set map[string]struct{}) []string {
+	s := make([]string, 0, len(set))
+	for key := range set {
+		s = append(s, key)
+	}
+	return s
+}
+
+// New returns a Hub of the server, it should be called before ListenAndServe
+func New(server *peregrine.Server, opts ...OptionFunc) *Hub {
+	h := &Hub{
+		server: server,
+		node:   uuid.New().String(),
+		topics: make(map[string]map[string]struct{}),
+		joined: make(map[string]map[string]struct{}),
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
+
+	server.UseOnCloseHandler(func(conn *peregrine.Conn, _ error) {
+		h.leaveAll(conn.ID)
+	})
+	if h.broker != nil {
+		h.broker.Subscribe(h.relay)
+	}
+	return h
+}
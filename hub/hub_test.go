@@ -0,0 +1,143 @@
+package hub_test
+
+import (
+	"bytes"
+	"github.com/RealFax/peregrine"
+	"github.com/RealFax/peregrine/hub"
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/panjf2000/gnet/v2"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+)
+
+const handshake = "GET / HTTP/1.1\r\n" +
+	"Host: 127.0.0.1\r\n" +
+	"Upgrade: websocket\r\n" +
+	"Connection: Upgrade\r\n" +
+	"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+	"Sec-WebSocket-Version: 13\r\n\r\n"
+
+// fakeConn is a gnet.Conn driven by the test, the asynchronous writes are applied immediately
+type fakeConn struct {
+	gnet.Conn
+	inbound bytes.Buffer
+	ctx     any
+
+	mu       sync.Mutex
+	outbound bytes.Buffer
+}
+
+func (c *fakeConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10000}
+}
+func (c *fakeConn) Context() any               { return c.ctx }
+func (c *fakeConn) SetContext(ctx any)         { c.ctx = ctx }
+func (c *fakeConn) InboundBuffered() int       { return c.inbound.Len() }
+func (c *fakeConn) Discard(n int) (int, error) { return len(c.inbound.Next(n)), nil }
+
+func (c *fakeConn) Peek(n int) ([]byte, error) {
+	if n > c.inbound.Len() {
+		return nil, io.ErrShortBuffer
+	}
+	if n <= 0 {
+		n = c.inbound.Len()
+	}
+	return c.inbound.Bytes()[:n], nil
+}
+
+func (c *fakeConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.outbound.Write(p)
+}
+
+func (c *fakeConn) AsyncWrite(p []byte, callback gnet.AsyncCallback) error {
+	_, err := c.Write(p)
+	if callback != nil {
+		return callback(c, err)
+	}
+	return err
+}
+
+// Len returns the length of written data
+func (c *fakeConn) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.outbound.Len()
+}
+
+// Outbound returns the written data and reset the outbound buffer
+func (c *fakeConn) Outbound() *bytes.Buffer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b := bytes.NewBuffer(append([]byte(nil), c.outbound.Bytes()...))
+	c.outbound.Reset()
+	return b
+}
+
+func upgrade(t *testing.T, s *peregrine.Server) (*fakeConn, *peregrine.Conn) {
+	c := &fakeConn{}
+	c.inbound.WriteString(handshake)
+	if action := s.OnTraffic(c); action != gnet.None {
+		t.Fatalf("unexpected action: %v", action)
+	}
+	c.Outbound()
+	return c, c.Context().(*peregrine.Conn)
+}
+
+func TestHub(t *testing.T) {
+	var (
+		s = peregrine.NewServer("tcp://127.0.0.1:0")
+		h = hub.New(s)
+
+		c1, conn1 = upgrade(t, s)
+		c2, conn2 = upgrade(t, s)
+	)
+
+	h.Join("lobby", conn1)
+	h.Join("lobby", conn2)
+	h.Join("room", conn2)
+
+	if h.Count("lobby") != 2 || !h.Joined("room", conn2) || h.Joined("room", conn1) {
+		t.Fatal("unexpected membership")
+	}
+	topics := h.Topics(conn2)
+	sort.Strings(topics)
+	if len(topics) != 2 || topics[0] != "lobby" || topics[1] != "room" {
+		t.Fatalf("unexpected topics: %v", topics)
+	}
+
+	// publish to lobby except conn1
+	if n, _ := h.Publish("lobby", ws.OpText, []byte("peregrine"), func(conn *peregrine.Conn) bool {
+		return conn != conn1
+	}); n != 1 {
+		t.Fatalf("expect publish to 1 conn, got: %d", n)
+	}
+	if c1.Len() != 0 {
+		t.Fatal("filtered conn received the message")
+	}
+	if message, err := wsutil.ReadServerText(c2.Outbound()); err != nil || string(message) != "peregrine" {
+		t.Fatalf("unexpected message: %s, %v", message, err)
+	}
+
+	h.Leave("lobby", conn1)
+	if h.Joined("lobby", conn1) || h.Count("lobby") != 1 {
+		t.Fatal("conn not left")
+	}
+
+	// closed conn leaves all topics
+	s.OnClose(c2, nil)
+	if h.Count("lobby") != 0 || h.Count("room") != 0 || len(h.Topics(conn2)) != 0 {
+		t.Fatal("closed conn not removed")
+	}
+
+	// join after closed is ignored
+	h.Join("lobby", conn2)
+	if h.Count("lobby") != 0 || len(h.Topics(conn2)) != 0 {
+		t.Fatal("closed conn joined")
+	}
+}
@@ -0,0 +1,8 @@
+package hub
+
+type OptionFunc func(*Hub)
+
+// WithBroker relay the published messages to the hubs of other nodes by broker
+func WithBroker(broker Broker) OptionFunc {
+	return func(h *Hub) { h.broker = broker }
+}
@@ -0,0 +1,346 @@
+package hub
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"github.com/gobwas/ws"
+	"github.com/pkg/errors"
+	"io"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// maxTCPMessageSize the limit of an encoded message relayed by TCPBroker
+	maxTCPMessageSize = 64 << 20
+
+	tcpDialTimeout  = 3 * time.Second
+	tcpWriteTimeout = 3 * time.Second
+	// tcpPeerBacklog the encoded messages queued for a peer, the messages published once it's full are dropped
+	tcpPeerBacklog = 1024
+)
+
+var (
+	ErrBrokerClosed   = errors.New("broker closed")
+	ErrMessageTooLong = errors.New("message too long")
+	ErrPeerBacklog    = errors.New("peer backlog full")
+	ErrInvalidOpCode  = errors.New("invalid opcode")
+)
+
+// TCPBroker is a reference Broker relays the messages between peregrine nodes over plain TCP.
+//
+// every node listens on an address and publishes to the addresses of the other nodes (full mesh),
+// the connections to peers are dialed on demand and re-dialed after failures.
+// the messages are queued for each peer and written by its own goroutine, a stalled peer never blocks Publish.
+//
+// the listener accepts the messages from any host without authentication, only the text and binary messages
+// are relayed. it must listen on a private network, or behind an authenticated tunnel (e.g. TLS, WireGuard).
+//
+// the message is encoded as:
+//
+//	| length uint32 | opcode uint8 | node length uint8 | node | topic length uint16 | topic | payload |
+type TCPBroker struct {
+	listener net.Listener
+
+	rwm      sync.RWMutex
+	closed   bool
+	peers    map[string]*tcpPeer   // map[Addr]*tcpPeer
+	inbound  map[net.Conn]struct{} // accepted conns
+	handlers []func(msg *Message)
+
+	wg sync.WaitGroup
+}
+
+// tcpPeer writes the queued messages to the peer by its own goroutine
+type tcpPeer struct {
+	addr  string
+	queue chan []byte
+	// ctx canceled once the broker closed
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu sync.Mutex
+	// conn written by the goroutine of peer, and closed by close
+	conn net.Conn
+}
+
+// Addr returns the listen address of broker
+func (b *TCPBroker) Addr() net.Addr {
+	return b.listener.Addr()
+}
+
+// AddPeer add the listen address of another node, the messages are published to it
+func (b *TCPBroker) AddPeer(addr string) {
+	b.rwm.Lock()
+	defer b.rwm.Unlock()
+
+	if _, ok := b.peers[addr]; ok || b.closed {
+		return
+	}
+	peer := &tcpPeer{addr: addr, queue: make(chan []byte, tcpPeerBacklog)}
+	peer.ctx, peer.cancel = context.WithCancel(context.Background())
+	b.peers[addr] = peer
+
+	b.wg.Add(1)
+	go peer.run(&b.wg)
+}
+
+// Publish queue msg to all peers without blocking, returns the first error of peers (e.g. ErrPeerBacklog).
+// the messages failed to write (e.g. the peer unreachable) are dropped
+func (b *TCPBroker) Publish(msg *Message) error {
+	p, err := encodeMessage(msg)
+	if err != nil {
+		return err
+	}
+
+	b.rwm.RLock()
+	if b.closed {
+		b.rwm.RUnlock()
+		return ErrBrokerClosed
+	}
+	peers := make([]*tcpPeer, 0, len(b.peers))
+	for _, peer := range b.peers {
+		peers = append(peers, peer)
+	}
+	b.rwm.RUnlock()
+
+	var first error
+	for _, peer := range peers {
+		if err = peer.enqueue(p); err != nil && first == nil {
+			first = errors.Wrapf(err, "publish to %s", peer.addr)
+		}
+	}
+	return first
+}
+
+func (b *TCPBroker) Subscribe(handler func(msg *Message)) {
+	b.rwm.Lock()
+	b.handlers = append(b.handlers[:len(b.handlers):len(b.handlers)], handler)
+	b.rwm.Unlock()
+}
+
+// Close stop listening and close all connections
+func (b *TCPBroker) Close() error {
+	b.rwm.Lock()
+	if b.closed {
+		b.rwm.Unlock()
+		return ErrBrokerClosed
+	}
+	b.closed = true
+	err := b.listener.Close()
+	for conn := range b.inbound {
+		_ = conn.Close()
+	}
+	for _, peer := range b.peers {
+		peer.close()
+	}
+	b.rwm.Unlock()
+
+	b.wg.Wait()
+	return err
+}
+
+func (b *TCPBroker) accept() {
+	defer b.wg.Done()
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		b.rwm.Lock()
+		if b.closed {
+			b.rwm.Unlock()
+			_ = conn.Close()
+			return
+		}
+		b.inbound[conn] = struct{}{}
+		b.wg.Add(1)
+		b.rwm.Unlock()
+
+		go b.serve(conn)
+	}
+}
+
+// serve read the messages from peer until the conn closed
+func (b *TCPBroker) serve(conn net.Conn) {
+	defer func() {
+		b.rwm.Lock()
+		delete(b.inbound, conn)
+		b.rwm.Unlock()
+		_ = conn.Close()
+		b.wg.Done()
+	}()
+
+	r := bufio.NewReader(conn)
+	for {
+		msg, err := decodeMessage(r)
+		if err != nil {
+			return
+		}
+
+		b.rwm.RLock()
+		handlers := b.handlers
+		b.rwm.RUnlock()
+
+		for _, handler := range handlers {
+			handler(msg)
+		}
+	}
+}
+
+// enqueue the encoded message, it never blocks
+func (p *tcpPeer) enqueue(b []byte) error {
+	select {
+	case p.queue <- b:
+		return nil
+	default:
+		return ErrPeerBacklog
+	}
+}
+
+// run write the queued messages until the broker closed
+func (p *tcpPeer) run(wg *sync.WaitGroup) {
+	defer wg.Done()
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case b := <-p.queue:
+			// the message is dropped if failed, the conn is re-dialed on next write
+			_ = p.write(b)
+		}
+	}
+}
+
+func (p *tcpPeer) write(b []byte) error {
+	p.mu.Lock()
+	conn := p.conn
+	p.mu.Unlock()
+
+	if conn == nil {
+		dialer := net.Dialer{Timeout: tcpDialTimeout}
+		c, err := dialer.DialContext(p.ctx, "tcp", p.addr)
+		if err != nil {
+			return err
+		}
+
+		p.mu.Lock()
+		if p.ctx.Err() != nil {
+			p.mu.Unlock()
+			_ = c.Close()
+			return ErrBrokerClosed
+		}
+		p.conn, conn = c, c
+		p.mu.Unlock()
+	}
+
+	_ = conn.SetWriteDeadline(time.Now().Add(tcpWriteTimeout))
+	if _, err := conn.Write(b); err != nil {
+		p.mu.Lock()
+		_ = conn.Close()
+		p.conn = nil
+		p.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (p *tcpPeer) close() {
+	p.mu.Lock()
+	p.cancel()
+	if p.conn != nil {
+		_ = p.conn.Close()
+		p.conn = nil
+	}
+	p.mu.Unlock()
+}
+
+func encodeMessage(msg *Message) ([]byte, error) {
+	if len(msg.Node) > math.MaxUint8 || len(msg.Topic) > math.MaxUint16 {
+		return nil, ErrMessageTooLong
+	}
+
+	size := 1 + 1 + len(msg.Node) + 2 + len(msg.Topic) + len(msg.Payload)
+	if size > maxTCPMessageSize {
+		return nil, ErrMessageTooLong
+	}
+
+	p := make([]byte, 4, 4+size)
+	binary.BigEndian.PutUint32(p, uint32(size))
+	p = append(p, byte(msg.OpCode), byte(len(msg.Node)))
+	p = append(p, msg.Node...)
+	p = binary.BigEndian.AppendUint16(p, uint16(len(msg.Topic)))
+	p = append(p, msg.Topic...)
+	p = append(p, msg.Payload...)
+	return p, nil
+}
+
+func decodeMessage(r io.Reader) (*Message, error) {
+	var length [4]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint32(length[:])
+	if size > maxTCPMessageSize {
+		return nil, ErrMessageTooLong
+	}
+
+	p := make([]byte, size)
+	if _, err := io.ReadFull(r, p); err != nil {
+		return nil, err
+	}
+
+	var (
+		msg = &Message{}
+		err = errors.New("malformed message")
+	)
+	if len(p) < 2 {
+		return nil, err
+	}
+	// the control frames are written by the server only
+	if msg.OpCode = ws.OpCode(p[0]); msg.OpCode != ws.OpText && msg.OpCode != ws.OpBinary {
+		return nil, ErrInvalidOpCode
+	}
+	nodeLen := int(p[1])
+	p = p[2:]
+
+	if len(p) < nodeLen+2 {
+		return nil, err
+	}
+	msg.Node = string(p[:nodeLen])
+	topicLen := int(binary.BigEndian.Uint16(p[nodeLen:]))
+	p = p[nodeLen+2:]
+
+	if len(p) < topicLen {
+		return nil, err
+	}
+	msg.Topic = string(p[:topicLen])
+	msg.Payload = p[topicLen:]
+	return msg, nil
+}
+
+// ListenTCPBroker returns a TCPBroker listens on addr, and publishes to peers
+func ListenTCPBroker(addr string, peers ...string) (*TCPBroker, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &TCPBroker{
+		listener: listener,
+		peers:    make(map[string]*tcpPeer),
+		inbound:  make(map[net.Conn]struct{}),
+	}
+	for _, peer := range peers {
+		b.AddPeer(peer)
+	}
+
+	b.wg.Add(1)
+	go b.accept()
+	return b, nil
+}
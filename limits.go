@@ -0,0 +1,130 @@
+package peregrine
+
+import (
+	"fmt"
+	"github.com/panjf2000/gnet/v2"
+	"github.com/pkg/errors"
+	"net"
+	"net/http"
+	"sync"
+)
+
+var (
+	ErrTooManyConnections      = errors.New("too many connections")
+	ErrTooManyConnectionsPerIP = errors.New("too many connections per ip")
+)
+
+// connLimits counts the TCP conns, the conns over limits are rejected once opened
+type connLimits struct {
+	// maxConns and maxPerIP zero means unlimited
+	maxConns int
+	maxPerIP int
+
+	mu    sync.Mutex
+	total int
+	perIP map[string]int
+}
+
+// acquire count the conn from ip, returns the error if the limits exceeded
+func (l *connLimits) acquire(ip string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.maxConns > 0 && l.total >= l.maxConns {
+		return ErrTooManyConnections
+	}
+	if l.maxPerIP > 0 && l.perIP[ip] >= l.maxPerIP {
+		return ErrTooManyConnectionsPerIP
+	}
+
+	if l.perIP == nil {
+		l.perIP = make(map[string]int)
+	}
+	l.total++
+	l.perIP[ip]++
+	return nil
+}
+
+func (l *connLimits) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.total--
+	if l.perIP[ip]--; l.perIP[ip] <= 0 {
+		delete(l.perIP, ip)
+	}
+}
+
+func (l *connLimits) count(ip string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.perIP[ip]
+}
+
+func (l *connLimits) snapshot() map[string]int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	counts := make(map[string]int, len(l.perIP))
+	for ip, n := range l.perIP {
+		counts[ip] = n
+	}
+	return counts
+}
+
+// remoteIP returns the ip of remote address, or the address if it's not an ip address
+func remoteIP(addr net.Addr) string {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr.IP.String()
+	case nil:
+		return ""
+	}
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		return host
+	}
+	return addr.String()
+}
+
+// acquireConn count the conn opened, the conn over limits is closed once opened with the rejection written.
+//
+// the rejected conns are not counted, they never wait for the handshake
+func (s *Server) acquireConn(conn *Conn) ([]byte, gnet.Action) {
+	conn.remoteIP = remoteIP(conn.RemoteAddr())
+	if err := s.limits.acquire(conn.remoteIP); err != nil {
+		s.logger.Warnf("[-] conn rejected: %s, remote: %s", err, conn.RemoteAddr())
+		conn.setCloseReason(err)
+		return rejection(err), gnet.Close
+	}
+	conn.counted = true
+	return nil, gnet.None
+}
+
+func (s *Server) releaseConn(conn *Conn) {
+	if conn.counted {
+		s.limits.release(conn.remoteIP)
+	}
+}
+
+// rejection returns the handshake response of the conn over limits, 503 (total) or 429 (per ip)
+func rejection(err error) []byte {
+	status := http.StatusServiceUnavailable
+	if errors.Is(err, ErrTooManyConnectionsPerIP) {
+		status = http.StatusTooManyRequests
+	}
+	reason := err.Error()
+	return []byte(fmt.Sprintf(
+		"HTTP/1.1 %d %s\r\nConnection: close\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Length: %d\r\n\r\n%s",
+		status, http.StatusText(status), len(reason), reason,
+	))
+}
+
+// ConnectionsPerIP returns the count of TCP conns of each remote ip
+func (s *Server) ConnectionsPerIP() map[string]int {
+	return s.limits.snapshot()
+}
+
+// ConnectionsOf returns the count of TCP conns of the remote ip
+func (s *Server) ConnectionsOf(ip string) int {
+	return s.limits.count(ip)
+}
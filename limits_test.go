@@ -0,0 +1,72 @@
+package peregrine
+
+import (
+	"github.com/panjf2000/gnet/v2"
+	"net"
+	"net/http"
+	"testing"
+)
+
+// openMockConn open a mockConn from ip and send the handshake, returns the status of handshake response
+func openMockConn(t *testing.T, s *Server, ip string) (*mockConn, int) {
+	c := &mockConn{remote: &net.TCPAddr{IP: net.ParseIP(ip), Port: 10000}}
+	out, action := s.OnOpen(c)
+	switch action {
+	case gnet.None:
+		c.inbound.WriteString(testHandshake)
+		_ = s.OnTraffic(c)
+	case gnet.Close:
+		// the conn over limits is closed once opened
+		c.outbound.Write(out)
+	default:
+		t.Fatalf("unexpected action: %v", action)
+	}
+
+	resp, _ := readHandshakeResponse(t, c)
+	return c, resp.StatusCode
+}
+
+func TestServer_MaxConnections(t *testing.T) {
+	s := NewServer(
+		"tcp://127.0.0.1:0",
+		WithMaxConnections(3),
+		WithMaxConnectionsPerIP(2),
+	)
+
+	tests := []struct {
+		ip     string
+		status int
+	}{
+		{ip: "10.0.0.1", status: http.StatusSwitchingProtocols},
+		{ip: "10.0.0.1", status: http.StatusSwitchingProtocols},
+		{ip: "10.0.0.1", status: http.StatusTooManyRequests},
+		{ip: "10.0.0.2", status: http.StatusSwitchingProtocols},
+		{ip: "10.0.0.3", status: http.StatusServiceUnavailable},
+	}
+
+	conns := make([]*mockConn, 0, len(tests))
+	for _, tt := range tests {
+		c, status := openMockConn(t, s, tt.ip)
+		if status != tt.status {
+			t.Fatalf("%s: expect status %d, got: %d", tt.ip, tt.status, status)
+		}
+		conns = append(conns, c)
+	}
+
+	counts := s.ConnectionsPerIP()
+	if len(counts) != 2 || counts["10.0.0.1"] != 2 || counts["10.0.0.2"] != 1 {
+		t.Fatalf("unexpected counts: %v", counts)
+	}
+
+	// the rejected conns are not counted
+	for _, c := range conns {
+		_ = s.OnClose(c, nil)
+	}
+	if n := s.ConnectionsOf("10.0.0.1"); n != 0 || len(s.ConnectionsPerIP()) != 0 {
+		t.Fatalf("conns not released, counts: %v", s.ConnectionsPerIP())
+	}
+
+	if _, status := openMockConn(t, s, "10.0.0.3"); status != http.StatusSwitchingProtocols {
+		t.Fatalf("unexpected status after released: %d", status)
+	}
+}
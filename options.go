@@ -4,9 +4,7 @@ import (
 	"context"
 	"crypto/tls"
 	"github.com/gobwas/ws"
-	"github.com/jellydator/ttlcache/v3"
 	"github.com/panjf2000/ants/v2"
-	"github.com/panjf2000/gnet/v2"
 	"net"
 	"time"
 )
@@ -23,16 +21,126 @@ func WithWorkerPool(size int, options ants.Options) OptionFunc {
 	return func(s *Server) { s.workerPool, _ = ants.NewPool(size, ants.WithOptions(options)) }
 }
 
+// WithDispatchMode set how messages are submitted to the worker pool,
+// DispatchOrdered keeps the messages from the same Conn in FIFO order
+func WithDispatchMode(mode DispatchMode) OptionFunc {
+	return func(s *Server) { s.dispatchMode = mode }
+}
+
+// WithOverloadPolicy set what to do with the messages when the worker pool is saturated
+func WithOverloadPolicy(policy OverloadPolicy) OptionFunc {
+	return func(s *Server) { s.overloadPolicy = policy }
+}
+
+// WithOverloadCloseCode set the close code sent by OverloadReject policy
+func WithOverloadCloseCode(statusCode ws.StatusCode) OptionFunc {
+	return func(s *Server) { s.overloadCloseCode = statusCode }
+}
+
+// WithOverloadQueueSize set the bound of the queue used by OverloadQueue policy
+func WithOverloadQueueSize(size int) OptionFunc {
+	return func(s *Server) { s.overloadQueue = make(chan func(), size) }
+}
+
+// WithShutdownClose set the close frame written to conns by Shutdown
+func WithShutdownClose(statusCode ws.StatusCode, reason string) OptionFunc {
+	return func(s *Server) {
+		s.shutdownCloseCode = statusCode
+		s.shutdownReason = reason
+	}
+}
+
+// WithStreamHandler enable the streaming mode, the data messages are handled by handler as streams
+// while their frames arriving, instead of the HandlerFunc.
+//
+// the compressed messages are inflated before handled, the text messages are not validated in strict protocol mode.
+// the messages streamed while their frames arriving are exempt from the rate limit (see WithRateLimit),
+// the stream window bounds them instead
+func WithStreamHandler(handler StreamHandlerFunc) OptionFunc {
+	return func(s *Server) { s.streamHandler = handler }
+}
+
+// WithStreamWindow set the payload bytes buffered of a streaming message (default 256KB),
+// the frames of conn are not decoded until the handler read the half of window
+func WithStreamWindow(size int) OptionFunc {
+	return func(s *Server) { s.streamWindow = size }
+}
+
+// WithMaxMessageSize close the conn with StatusMessageTooBig (1009) if the inbound message exceeded size,
+// the frame is rejected by the length in its header before the payload read.
+// the fragmented messages are limited by the total size, the compressed messages by the decompressed size
+func WithMaxMessageSize(size int64) OptionFunc {
+	return func(s *Server) { s.maxMessageSize = size }
+}
+
+// WithStrictProtocol enable the strict checks of RFC 6455:
+// the text messages must be valid UTF-8, the close frames are validated and echoed with the status of peer,
+// the conns failed by protocol errors are closed with StatusProtocolError (1002) or StatusInvalidFramePayloadData (1007)
+func WithStrictProtocol() OptionFunc {
+	return func(s *Server) { s.strictProtocol = true }
+}
+
+// WithWriteCoalescing batch the frames written to a conn until the event-loop runs,
+// the batch is written with a single writev and wakes the event-loop once
+func WithWriteCoalescing() OptionFunc {
+	return func(s *Server) { s.writeCoalescing = true }
+}
+
 func WithUpgrader(upgrader *ws.Upgrader) OptionFunc {
 	return func(s *Server) { s.upgrader = upgrader }
 }
 
+// WithCompression enable the permessage-deflate extension (RFC 7692),
+// inbound messages are inflated before handled and outbound messages written by Conn.WriteMessage are compressed
+func WithCompression(options CompressionOptions) OptionFunc {
+	return func(s *Server) { s.compression = &options }
+}
+
+// WithConnTimeout same as WithIdleTimeout
 func WithConnTimeout(timeout time.Duration) OptionFunc {
+	return WithIdleTimeout(timeout)
+}
+
+// WithHandshakeTimeout close the conn not upgraded in timeout, zero means the idle timeout is used
+func WithHandshakeTimeout(timeout time.Duration) OptionFunc {
+	return func(s *Server) { s.timeouts.handshake = timeout }
+}
+
+// WithIdleTimeout close the conn with StatusGoingAway if no traffic arrived in timeout (default 15s), zero means disabled
+func WithIdleTimeout(timeout time.Duration) OptionFunc {
+	return func(s *Server) { s.timeouts.idleRead = timeout }
+}
+
+// WithWriteStallTimeout close the conn if the outbound buffer not flushed in timeout, zero (default) means disabled
+func WithWriteStallTimeout(timeout time.Duration) OptionFunc {
+	return func(s *Server) { s.timeouts.writeStall = timeout }
+}
+
+// WithHeartbeat send a ping to the conn every interval, close the conn if the pong not arrived in timeout,
+// the RTT measured by heartbeat can be read by Conn.RTT
+func WithHeartbeat(interval, timeout time.Duration) OptionFunc {
+	return func(s *Server) {
+		s.timeouts.pingInterval = interval
+		s.timeouts.pongTimeout = timeout
+	}
+}
+
+// WithTimeoutTick set the resolution of timeouts (default 100ms), the timeouts are checked in gnet OnTick
+func WithTimeoutTick(tick time.Duration) OptionFunc {
+	return func(s *Server) { s.wheel = newTimingWheel(tick) }
+}
+
+// WithSubprotocols negotiate the subprotocol by Sec-WebSocket-Protocol, the packets of conn are handled by
+// the handler of negotiated subprotocol. the conn negotiated no subprotocol is handled by the default handler.
+//
+// the protocols are selected in the order of client requested, Upgrader.Protocol is ignored.
+// the conns matched a route are handled by the handler of route regardless of the subprotocol
+func WithSubprotocols(handlers map[string]HandlerFunc) OptionFunc {
 	return func(s *Server) {
-		s.timeout = timeout
-		s.connTable = ttlcache.New[string, gnet.Conn](
-			ttlcache.WithTTL[string, gnet.Conn](timeout),
-		)
+		s.subprotocols = make(map[string]HandlerFunc, len(handlers))
+		for protocol, handler := range handlers {
+			s.subprotocols[protocol] = handler
+		}
 	}
 }
 
@@ -40,14 +148,100 @@ func WithLogger(logger Logger) OptionFunc {
 	return func(s *Server) { s.logger = logger }
 }
 
+// WithOnOpenHandler set the handler called after the handshake succeeded, see OnOpenHandlerFunc
+func WithOnOpenHandler(handler OnOpenHandlerFunc) OptionFunc {
+	return func(s *Server) { s.onOpenHandler = handler }
+}
+
+// WithRateLimit set the default rate limit of inbound messages of conns, see RateLimit.
+// the rate limit of a conn can be adjusted at runtime by Conn.SetRateLimit
+func WithRateLimit(limit RateLimit, policy RateLimitPolicy) OptionFunc {
+	return func(s *Server) {
+		s.rateLimit = limit
+		s.rateLimitPolicy = policy
+	}
+}
+
+// WithOnRateLimitedHandler set the handler called with the messages exceeded the rate limit
+func WithOnRateLimitedHandler(handler OnRateLimitedHandlerFunc) OptionFunc {
+	return func(s *Server) { s.onRateLimitedHandler = handler }
+}
+
+// WithMaxOutboundBuffer limit the pending outbound bytes of a conn (queued and not flushed to the socket),
+// the policy is applied to the frames over limit. zero (default) means unlimited
+func WithMaxOutboundBuffer(size int, policy SlowConsumerPolicy) OptionFunc {
+	return func(s *Server) {
+		s.maxOutbound = size
+		s.slowConsumerPolicy = policy
+	}
+}
+
+// WithSlowConsumerCloseCode set the close code of SlowConsumerClose, default StatusTryAgainLater (1013)
+func WithSlowConsumerCloseCode(statusCode ws.StatusCode) OptionFunc {
+	return func(s *Server) { s.slowConsumerCloseCode = statusCode }
+}
+
+// WithOnSlowConsumerHandler set the handler called when the outbound buffer of a conn exceeded the limit
+func WithOnSlowConsumerHandler(handler OnSlowConsumerHandlerFunc) OptionFunc {
+	return func(s *Server) { s.onSlowConsumerHandler = handler }
+}
+
+// WithMaxConnections limit the count of TCP conns, the conn over limit is rejected with 503 once opened.
+// zero (default) means unlimited
+func WithMaxConnections(n int) OptionFunc {
+	return func(s *Server) { s.limits.maxConns = n }
+}
+
+// WithMaxConnectionsPerIP limit the count of TCP conns of each remote ip, the conn over limit is rejected with 429 once opened.
+// zero (default) means unlimited
+func WithMaxConnectionsPerIP(n int) OptionFunc {
+	return func(s *Server) { s.limits.maxPerIP = n }
+}
+
+// WithAllowedOrigins reject the browser handshakes with 403 if the Origin header not matched any pattern,
+// it prevents the cross-site WebSocket hijacking. the pattern can be:
+//
+//   - exact: "https://example.com"
+//   - wildcard subdomain: "https://*.example.com"
+//   - regexp prefixed by "regexp:": "regexp:https://[a-z]+\\.example\\.com", it's anchored to match the whole origin
+//   - "*" allows any origin
+//
+// the invalid regexp is logged and skipped. the handshakes without Origin header (non-browser clients) are allowed
+func WithAllowedOrigins(patterns ...string) OptionFunc {
+	return func(s *Server) { s.allowedOrigins = append([]string{}, patterns...) }
+}
+
+// WithOnHandshakeHandler append the handler called during the handshake, see OnHandshakeHandlerFunc.
+// the handlers (e.g. auth.WithAuthenticator) are called in the order of options until one failed,
+// the request is parsed only if any handler set
+func WithOnHandshakeHandler(handler OnHandshakeHandlerFunc) OptionFunc {
+	return func(s *Server) { s.UseOnHandshakeHandler(handler) }
+}
+
+// WithOnUpgradeErrorHandler set the handler called when the handshake failed
+func WithOnUpgradeErrorHandler(handler OnUpgradeErrorHandlerFunc) OptionFunc {
+	return func(s *Server) { s.onUpgradeErrorHandler = handler }
+}
+
 func WithOnCloseHandler(handler OnCloseHandlerFunc) OptionFunc {
 	return func(s *Server) { s.onCloseHandler = handler }
 }
 
+// WithOnPingHandler set the handler called after the server answered the ping with a pong carrying its payload,
+// the handler must not write another pong
 func WithOnPingHandler(handler OnPingHandlerFunc) OptionFunc {
 	return func(s *Server) { s.onPingHandler = handler }
 }
 
+// WithOnPongHandler set the handler called with the pong frames, the RTT has been measured before called
+func WithOnPongHandler(handler OnPongHandlerFunc) OptionFunc {
+	return func(s *Server) { s.onPongHandler = handler }
+}
+
+func WithOnOverloadHandler(handler OnOverloadHandlerFunc) OptionFunc {
+	return func(s *Server) { s.onOverloadHandler = handler }
+}
+
 func WithHandler(handler HandlerFunc) OptionFunc {
 	return func(s *Server) { s.handler = handler }
 }
@@ -84,6 +278,13 @@ func WithClientTLSConfig(tlsConfig *tls.Config) ClientOptionFunc {
 	}
 }
 
+// WithClientCompression offer the permessage-deflate extension (RFC 7692) during dial
+func WithClientCompression(options CompressionOptions) ClientOptionFunc {
+	return func(c *Client) {
+		c.compression = &options
+	}
+}
+
 func WithClientWrapConn(wrapConn func(conn net.Conn) net.Conn) ClientOptionFunc {
 	return func(c *Client) {
 		c.dialer.WrapConn = wrapConn
@@ -0,0 +1,94 @@
+package peregrine
+
+import (
+	"github.com/gobwas/ws"
+	"github.com/panjf2000/gnet/v2"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+const regexpOriginPrefix = "regexp:"
+
+// origins the allowlist of the Origin header of browser handshakes
+type origins struct {
+	any      bool
+	exact    map[string]struct{}
+	wildcard []string // the suffix of host, e.g. ".example.com" of "https://*.example.com"
+	schemes  []string // the scheme of wildcard
+	patterns []*regexp.Regexp
+}
+
+// newOrigins compile the patterns, the invalid regexp is logged and skipped
+func newOrigins(patterns []string, logger Logger) *origins {
+	o := &origins{exact: make(map[string]struct{})}
+	for _, pattern := range patterns {
+		switch {
+		case pattern == "*":
+			o.any = true
+		case strings.HasPrefix(pattern, regexpOriginPrefix):
+			// anchored, the regexp must match the whole origin
+			re, err := regexp.Compile("^(?:" + strings.TrimPrefix(pattern, regexpOriginPrefix) + ")$")
+			if err != nil {
+				logger.Errorf("[-] invalid origin pattern: %s, err: %s", pattern, err)
+				continue
+			}
+			o.patterns = append(o.patterns, re)
+		case strings.Contains(pattern, "://*."):
+			scheme, host, _ := strings.Cut(strings.ToLower(pattern), "://*")
+			o.schemes = append(o.schemes, scheme)
+			o.wildcard = append(o.wildcard, host)
+		default:
+			o.exact[strings.ToLower(strings.TrimSuffix(pattern, "/"))] = struct{}{}
+		}
+	}
+	return o
+}
+
+func (o *origins) allowed(origin string) bool {
+	if o.any {
+		return true
+	}
+	origin = strings.ToLower(origin)
+	if _, ok := o.exact[origin]; ok {
+		return true
+	}
+
+	if len(o.wildcard) != 0 {
+		if u, err := url.Parse(origin); err == nil && u.Host != "" {
+			for i, suffix := range o.wildcard {
+				// the subdomains only, the port is matched as part of host
+				if u.Scheme == o.schemes[i] && strings.HasSuffix(u.Host, suffix) && len(u.Host) > len(suffix) {
+					return true
+				}
+			}
+		}
+	}
+
+	for _, pattern := range o.patterns {
+		if pattern.MatchString(origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkOrigin returns the header hook reject the handshake of origin not allowed with 403.
+//
+// the handshake without Origin header is allowed, it's not sent by browsers
+func (s *Server) checkOrigin(c gnet.Conn, onHeader func(key, value []byte) error) func(key, value []byte) error {
+	return HeaderProxy(func(key, value string) error {
+		if strings.EqualFold(key, "Origin") && !s.origins.allowed(value) {
+			s.logger.Warnf("[-] origin rejected: %s, remote: %s", value, c.RemoteAddr())
+			return ws.RejectConnectionError(
+				ws.RejectionStatus(http.StatusForbidden),
+				ws.RejectionReason("origin not allowed: "+value),
+			)
+		}
+		if onHeader != nil {
+			return onHeader([]byte(key), []byte(value))
+		}
+		return nil
+	})
+}
@@ -0,0 +1,90 @@
+package peregrine
+
+import (
+	"github.com/panjf2000/gnet/v2"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// errorLogger count the errors logged
+type errorLogger struct {
+	Logger
+	errors int
+}
+
+func (l *errorLogger) Errorf(_ string, _ ...any) { l.errors++ }
+
+func TestOrigins(t *testing.T) {
+	logger := &errorLogger{Logger: DefaultLogger}
+	o := newOrigins([]string{
+		"https://example.com/",
+		"https://*.example.org",
+		`regexp:https://app-[0-9]+\.example\.net`,
+		"regexp:https://(",
+	}, logger)
+	if logger.errors != 1 || len(o.patterns) != 1 {
+		t.Fatalf("expect the invalid regexp logged and skipped, errors: %d", logger.errors)
+	}
+
+	tests := map[string]bool{
+		"https://example.com":                         true,
+		"HTTPS://EXAMPLE.COM":                         true,
+		"http://example.com":                          false,
+		"https://evil.com":                            false,
+		"https://chat.example.org":                    true,
+		"https://a.b.example.org":                     true,
+		"https://example.org":                         false,
+		"https://evilexample.org":                     false,
+		"http://chat.example.org":                     false,
+		"https://app-1.example.net":                   true,
+		"https://app-x.example.net":                   false,
+		"https://app-1.example.net.io":                false,
+		"https://evil.com/?https://app-1.example.net": false,
+		"null": false,
+	}
+	for origin, expect := range tests {
+		if o.allowed(origin) != expect {
+			t.Fatalf("origin %s, expect allowed: %v", origin, expect)
+		}
+	}
+
+	if !newOrigins([]string{"*"}, DefaultLogger).allowed("https://evil.com") {
+		t.Fatal("any origin not allowed")
+	}
+}
+
+func TestServer_AllowedOrigins(t *testing.T) {
+	s := NewServer("tcp://127.0.0.1:0", WithAllowedOrigins("https://example.com"))
+
+	tests := []struct {
+		origin string
+		status int
+	}{
+		{origin: "https://example.com", status: http.StatusSwitchingProtocols},
+		{origin: "https://evil.com", status: http.StatusForbidden},
+		// non-browser clients
+		{status: http.StatusSwitchingProtocols},
+	}
+	for _, tt := range tests {
+		c := &mockConn{}
+		handshake := testHandshake
+		if tt.origin != "" {
+			handshake = strings.TrimSuffix(handshake, "\r\n") + "Origin: " + tt.origin + "\r\n\r\n"
+		}
+		c.inbound.WriteString(handshake)
+		action := s.OnTraffic(c)
+
+		resp, _ := readHandshakeResponse(t, c)
+		if resp.StatusCode != tt.status {
+			t.Fatalf("origin %q, expect status %d, got: %d", tt.origin, tt.status, resp.StatusCode)
+		}
+		if tt.status == http.StatusForbidden {
+			body, _ := io.ReadAll(resp.Body)
+			if action != gnet.Close || !strings.Contains(string(body), "origin not allowed") {
+				t.Fatalf("unexpected rejection: %v, %s", action, body)
+			}
+		}
+	}
+}
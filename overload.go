@@ -0,0 +1,161 @@
+package peregrine
+
+import (
+	"github.com/gobwas/ws"
+	"github.com/panjf2000/ants/v2"
+	"github.com/panjf2000/gnet/v2"
+	"github.com/pkg/errors"
+	"time"
+)
+
+// StatusTryAgainLater is the close code (1013) sent when the server is overloaded
+const StatusTryAgainLater ws.StatusCode = 1013
+
+var (
+	ErrOverload = errors.New("worker pool overload")
+)
+
+// OverloadPolicy decides what to do with a message when the worker pool is saturated
+type OverloadPolicy uint8
+
+const (
+	// OverloadDrop drop the message
+	OverloadDrop OverloadPolicy = iota
+
+	// OverloadBlock block the event-loop until the worker pool accepts the message
+	OverloadBlock
+
+	// OverloadReject drop the message and close the Conn with the overload close code
+	OverloadReject
+
+	// OverloadQueue put the message into a bounded queue,
+	// queued messages are submitted as soon as the worker pool has capacity.
+	// the message is dropped if the queue is full
+	OverloadQueue
+
+	// OverloadHandler drop the message and call the OnOverloadHandlerFunc
+	OverloadHandler
+)
+
+const (
+	overloadRetryInterval = time.Millisecond
+)
+
+// DroppedMessages returns the count of messages dropped because of worker pool saturation
+func (s *Server) DroppedMessages() uint64 {
+	return s.dropped.Load()
+}
+
+// QueuedMessages returns the count of messages put into the overload queue
+func (s *Server) QueuedMessages() uint64 {
+	return s.queued.Load()
+}
+
+// overload apply the overload policy to the task which the worker pool rejected,
+// reports whether the task is dropped
+func (s *Server) overload(packet *Packet, task func(), err error) (gnet.Action, bool) {
+	switch s.overloadPolicy {
+	case OverloadBlock:
+		for errors.Is(err, ants.ErrPoolOverload) {
+			time.Sleep(overloadRetryInterval)
+			err = s.workerPool.Submit(task)
+		}
+		if err == nil {
+			return gnet.None, false
+		}
+	case OverloadQueue:
+		if errors.Is(err, ants.ErrPoolOverload) && s.enqueue(task) {
+			s.queued.Add(1)
+			return gnet.None, false
+		}
+	}
+
+	// message dropped
+	if s.dispatchMode == DispatchOrdered {
+		packet.Conn.mailbox.abort()
+	}
+	s.dropped.Add(1)
+	s.inflight.Add(-1)
+	// the task never runs, release the pooled packet. the overload handler must Retain it to keep
+	defer packet.Release()
+
+	switch s.overloadPolicy {
+	case OverloadReject:
+		return s.closeConn(packet.Conn, s.overloadCloseCode, ErrOverload), true
+	case OverloadHandler:
+		s.onOverloadHandler(packet.Conn, packet)
+	default:
+		s.logger.Warnf("[-] message dropped: %s, remote: %s", err, packet.Conn.RemoteAddr())
+	}
+	return gnet.None, true
+}
+
+// enqueue put task into the overload queue, reports false if the queue is full or stopped
+func (s *Server) enqueue(task func()) bool {
+	s.queueMu.RLock()
+	defer s.queueMu.RUnlock()
+	if s.queueClosed {
+		return false
+	}
+	select {
+	case s.overloadQueue <- task:
+		return true
+	default:
+		return false
+	}
+}
+
+// runQueued run the queued task on the calling goroutine if the worker pool can't,
+// the task settles the in-flight count, the pooled packet and the mailbox of conn itself
+func (s *Server) runQueued(task func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			s.logger.Errorf("[-] queued task panic: %v", r)
+		}
+	}()
+	task()
+}
+
+// startOverloadQueue submit the queued tasks to the worker pool until the server context done,
+// the tasks left in the queue are run before it returns
+func (s *Server) startOverloadQueue() {
+	if s.overloadPolicy != OverloadQueue {
+		return
+	}
+
+	go func() {
+		defer func() {
+			s.queueMu.Lock()
+			s.queueClosed = true
+			s.queueMu.Unlock()
+			for {
+				select {
+				case task := <-s.overloadQueue:
+					s.runQueued(task)
+				default:
+					return
+				}
+			}
+		}()
+
+		for {
+			select {
+			case <-s.ctx.Done():
+				return
+			case task := <-s.overloadQueue:
+				for {
+					err := s.workerPool.Submit(task)
+					if err == nil {
+						break
+					}
+					if !errors.Is(err, ants.ErrPoolOverload) || s.ctx.Err() != nil {
+						// worker pool closed or server stopped
+						s.runQueued(task)
+						break
+					}
+					time.Sleep(overloadRetryInterval)
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,149 @@
+package peregrine
+
+import (
+	"encoding/binary"
+	"github.com/gobwas/ws"
+	"github.com/panjf2000/gnet/v2"
+	"sync"
+)
+
+const (
+	// maxPooledBuffer the buffers larger than it are left to the GC, so a burst of big messages won't be pinned
+	maxPooledBuffer = 64 << 10
+	// defaultPooledBuffer the initial capacity of pooled buffers
+	defaultPooledBuffer = 512
+)
+
+var (
+	payloadPool = sync.Pool{New: func() any {
+		b := make([]byte, 0, defaultPooledBuffer)
+		return &b
+	}}
+
+	// packetPool and framePool have no New, the pooled objects refer to the pool itself
+	packetPool sync.Pool
+	framePool  sync.Pool
+)
+
+// getPayload returns a pooled buffer of n bytes
+func getPayload(n int) *[]byte {
+	buf := payloadPool.Get().(*[]byte)
+	if cap(*buf) < n {
+		*buf = make([]byte, n)
+	}
+	*buf = (*buf)[:n]
+	return buf
+}
+
+func putPayload(buf *[]byte) {
+	if cap(*buf) > maxPooledBuffer {
+		return
+	}
+	payloadPool.Put(buf)
+}
+
+// message is a decoded message, buf the pooled buffer of Payload (nil if Payload is not pooled)
+type message struct {
+	OpCode  ws.OpCode
+	Payload []byte
+	buf     *[]byte
+}
+
+// release return the pooled buffer of message which won't be handled
+func (m *message) release() {
+	if m.buf != nil {
+		putPayload(m.buf)
+		m.buf = nil
+	}
+}
+
+// acquirePacket returns a pooled packet owned by the server, the payload buffer of message is taken over
+func (s *Server) acquirePacket(conn *Conn, m message) *Packet {
+	p, ok := packetPool.Get().(*Packet)
+	if !ok {
+		p = &Packet{pooled: true}
+		p.task = p.run
+	}
+	p.OpCode, p.Request, p.Conn = m.OpCode, m.Payload, conn
+	p.buf, p.inflight = m.buf, &s.inflight
+	p.refs.Store(1)
+	return p
+}
+
+// run the handler of conn with packet then release it, it's the cached task of pooled packet
+func (p *Packet) run() {
+	inflight := p.inflight
+	defer inflight.Add(-1)
+	defer p.Release()
+	p.Conn.handler(p)
+}
+
+// Retain keep the packet and its Request after the handler returned, it must be paired with Release.
+//
+// the packets passed to handlers are pooled, the Request is reused once the handler returned unless retained
+func (p *Packet) Retain() {
+	if p.pooled {
+		p.refs.Add(1)
+	}
+}
+
+// Release the packet retained by Retain, the packet and its Request must not be used after released
+func (p *Packet) Release() {
+	if !p.pooled || p.refs.Add(-1) != 0 {
+		return
+	}
+	if p.buf != nil {
+		putPayload(p.buf)
+	}
+	p.OpCode, p.Request, p.Conn = 0, nil, nil
+	p.buf, p.inflight = nil, nil
+	packetPool.Put(p)
+}
+
+// frameBuffer is a pooled buffer of outbound frame, released by the event-loop once written
+type frameBuffer struct {
+	b       []byte
+	release gnet.AsyncCallback
+}
+
+func getFrameBuffer() *frameBuffer {
+	fb, ok := framePool.Get().(*frameBuffer)
+	if !ok {
+		fb = &frameBuffer{b: make([]byte, 0, defaultPooledBuffer)}
+		fb.release = func(_ gnet.Conn, _ error) error {
+			fb.put()
+			return nil
+		}
+	}
+	return fb
+}
+
+func (fb *frameBuffer) put() {
+	if cap(fb.b) > maxPooledBuffer {
+		return
+	}
+	fb.b = fb.b[:0]
+	framePool.Put(fb)
+}
+
+// appendFrame encode the unmasked frame of server into b
+func appendFrame(b []byte, frame ws.Frame) []byte {
+	b0 := byte(frame.Header.OpCode) | frame.Header.Rsv<<4
+	if frame.Header.Fin {
+		b0 |= 0x80
+	}
+	b = append(b, b0)
+
+	length := len(frame.Payload)
+	switch {
+	case length < 126:
+		b = append(b, byte(length))
+	case length <= 0xffff:
+		b = append(b, 126)
+		b = binary.BigEndian.AppendUint16(b, uint16(length))
+	default:
+		b = append(b, 127)
+		b = binary.BigEndian.AppendUint64(b, uint64(length))
+	}
+	return append(b, frame.Payload...)
+}
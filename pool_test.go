@@ -0,0 +1,116 @@
+package peregrine
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/gobwas/ws"
+	"testing"
+	"time"
+)
+
+func TestAppendFrame(t *testing.T) {
+	for _, size := range []int{0, 125, 126, 0xffff, 0x10000} {
+		frame := ws.NewBinaryFrame(bytes.Repeat([]byte{'p'}, size))
+		expect, err := ws.CompileFrame(frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(appendFrame(nil, frame), expect) {
+			t.Fatalf("unexpected frame of %d bytes payload", size)
+		}
+	}
+
+	frame := ws.NewFrame(ws.OpText, false, []byte("peregrine"))
+	frame.Header.Rsv = ws.Rsv(true, false, false)
+	expect, _ := ws.CompileFrame(frame)
+	if !bytes.Equal(appendFrame(nil, frame), expect) {
+		t.Fatal("unexpected frame with rsv bits")
+	}
+}
+
+func TestPacket_Retain(t *testing.T) {
+	var (
+		retained = make(chan *Packet, 1)
+		handled  = make(chan struct{}, 16)
+	)
+	s := NewServer(
+		"tcp://127.0.0.1:0",
+		WithDispatchMode(DispatchOrdered),
+		WithHandler(func(packet *Packet) {
+			if string(packet.Request) == "retain" {
+				packet.Retain()
+				retained <- packet
+			}
+			handled <- struct{}{}
+		}),
+	)
+	c, conn := upgradeMockConn(t, s)
+
+	c.inbound.Write(compileClientFrame(t, ws.NewTextFrame([]byte("retain"))))
+	s.OnTraffic(c)
+	packet := <-retained
+	<-handled
+
+	// the buffers released by other packets never overwrite the retained one
+	for i := 0; i < 10; i++ {
+		c.inbound.Write(compileClientFrame(t, ws.NewTextFrame([]byte("others"))))
+	}
+	s.OnTraffic(c)
+	for i := 0; i < 10; i++ {
+		select {
+		case <-handled:
+		case <-time.After(time.Second):
+			t.Fatal("message not handled")
+		}
+	}
+	if string(packet.Request) != "retain" || packet.Conn != conn {
+		t.Fatalf("retained packet modified: %q", packet.Request)
+	}
+
+	packet.Release()
+	if packet.Request != nil || packet.Conn != nil {
+		t.Fatal("packet not recycled")
+	}
+
+	// the packets not borrowed from pool are never recycled
+	packet = &Packet{Request: []byte("peregrine")}
+	packet.Retain()
+	packet.Release()
+	if packet.Request == nil {
+		t.Fatal("unpooled packet recycled")
+	}
+}
+
+// BenchmarkServer_Echo the allocations of handling an echo message, zero at steady state
+func BenchmarkServer_Echo(b *testing.B) {
+	for _, mode := range []struct {
+		name string
+		mode DispatchMode
+	}{{"concurrent", DispatchConcurrent}, {"ordered", DispatchOrdered}} {
+		for _, size := range []int{64, 4096} {
+			b.Run(fmt.Sprintf("%s/%d", mode.name, size), func(b *testing.B) {
+				done := make(chan struct{}, 1)
+				s := NewServer(
+					"tcp://127.0.0.1:0",
+					WithDispatchMode(mode.mode),
+					WithHandler(func(packet *Packet) {
+						_ = packet.Conn.WriteMessage(packet.OpCode, packet.Request)
+						done <- struct{}{}
+					}),
+				)
+				c, _ := upgradeMockConn(b, s)
+				frame := compileClientFrame(b, ws.NewBinaryFrame(bytes.Repeat([]byte{'p'}, size)))
+
+				b.ReportAllocs()
+				b.SetBytes(int64(size))
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					c.inbound.Write(frame)
+					s.OnTraffic(c)
+					<-done
+					c.outbound.Reset()
+				}
+			})
+		}
+	}
+}
@@ -10,7 +10,8 @@ const (
 )
 
 type Config struct {
-	// maxPayloadSize Specifies the maximum packet size that can be handled, unit: byte
+	// maxPayloadSize Specifies the maximum packet size that can be handled, unit: byte.
+	// it's checked after the message read, see peregrine.WithMaxMessageSize to reject at the frame layer
 	maxPayloadSize atomic.Uint64
 
 	// maxErrorCount closed after the count of client errors reaches or exceeds the maxErrorCount
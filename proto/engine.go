@@ -2,12 +2,12 @@ package proto
 
 import (
 	"bytes"
-	"context"
 	"github.com/RealFax/peregrine"
 	"github.com/gobwas/ws"
 	"github.com/pkg/errors"
 	"os"
 	"runtime/debug"
+	"sync"
 	"sync/atomic"
 )
 
@@ -15,6 +15,8 @@ const (
 	KeyErrorCount = "peregrine_proto_error_count"
 )
 
+var readerPool = sync.Pool{New: func() any { return new(bytes.Reader) }}
+
 type (
 	HandlerFunc[T any]                    func(request *Request[T])
 	BrokerFunc[T any]                     func(request *Request[T]) error
@@ -59,11 +61,7 @@ func (e *Engine[T, K]) handlerError(packet *peregrine.Packet, err error) {
 
 	count := atomic.AddUint32(counter, 1)
 	if count >= e.MaxErrorCount() {
-		defer packet.Conn.Close()
-		ws.WriteFrame(
-			packet.Conn,
-			ws.NewCloseFrame(ws.NewCloseFrameBody(ws.StatusGoingAway, "too many error")),
-		)
+		_ = packet.Conn.WriteClose(ws.StatusGoingAway, "too many error")
 		return
 	}
 }
@@ -88,7 +86,12 @@ func (e *Engine[T, K]) handler(packet *peregrine.Packet) {
 	}
 
 	var err error
-	if err = e.codec.Unmarshal(packet.Conn.ID, bytes.NewReader(packet.Request), proto); err != nil {
+	r := readerPool.Get().(*bytes.Reader)
+	r.Reset(packet.Request)
+	err = e.codec.Unmarshal(packet.Conn.ID, r, proto)
+	r.Reset(nil)
+	readerPool.Put(r)
+	if err != nil {
 		e.handlerError(packet, errors.Wrap(err, "codec error"))
 		return
 	}
@@ -100,7 +103,7 @@ func (e *Engine[T, K]) handler(packet *peregrine.Packet) {
 	}
 
 	req := &Request[T]{
-		Context: context.Background(),
+		Context: packet.Conn.Context(),
 		OpCode:  packet.OpCode,
 		Conn:    packet.Conn,
 		Request: proto.Self(),
@@ -1,6 +1,7 @@
 package proto_test
 
 import (
+	"context"
 	"github.com/RealFax/peregrine"
 	"github.com/RealFax/peregrine/proto"
 	"github.com/gobwas/ws"
@@ -30,6 +31,29 @@ func init() {
 	})
 }
 
+func TestEngine_Context(t *testing.T) {
+	type key struct{}
+	var captured context.Context
+	// a fresh engine, the shared one is served by TestEngine_Handler
+	engine := proto.New[Proto, uint32](func() proto.Proto[Proto, uint32] {
+		return new(Proto)
+	})
+	engine.Register(3, func(r *proto.Request[Proto]) {
+		captured = r.Context
+	})
+
+	conn := peregrine.NewUpgraderConn(nil)
+	conn.SetContext(context.WithValue(context.Background(), key{}, "peregrine"))
+	engine.UseHandler()(&peregrine.Packet{
+		OpCode:  ws.OpText,
+		Request: []byte(`{"type":3}`),
+		Conn:    conn,
+	})
+	if captured == nil || captured.Value(key{}) != "peregrine" {
+		t.Fatal("request context not derived from the conn")
+	}
+}
+
 func TestEngine_Handler(t *testing.T) {
 	server := peregrine.NewServer(
 		"tcp://127.0.0.1:10001",
@@ -5,16 +5,17 @@ import (
 	"context"
 	"github.com/RealFax/peregrine"
 	"github.com/gobwas/ws"
-	"github.com/gobwas/ws/wsutil"
 	"io"
 )
 
 type Request[T any] struct {
 	OpCode ws.OpCode
 
+	// Context the context of Conn, canceled once the conn closed
 	Context context.Context
 	Conn    *peregrine.Conn
 	Request *T
+	// Payload is only valid until the handler returned, copy it to keep it longer
 	Payload []byte
 }
 
@@ -26,14 +27,17 @@ func (t Request[T]) Reader() io.Reader {
 }
 
 func (t Request[T]) WriteText(p []byte) error {
-	return wsutil.WriteServerMessage(t.Conn, ws.OpText, p)
+	return t.Conn.WriteText(p)
 }
 
 func (t Request[T]) WriteBinary(p []byte) error {
-	return wsutil.WriteServerMessage(t.Conn, ws.OpBinary, p)
+	return t.Conn.WriteBinary(p)
+}
+
+func (t Request[T]) WriteJSON(v any) error {
+	return t.Conn.WriteJSON(v)
 }
 
 func (t Request[T]) WriteClose(statusCode ws.StatusCode, reason string) error {
-	defer t.Conn.Close()
-	return wsutil.WriteServerMessage(t.Conn, ws.OpClose, ws.NewCloseFrameBody(statusCode, reason))
+	return t.Conn.WriteClose(statusCode, reason)
 }
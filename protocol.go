@@ -0,0 +1,116 @@
+package peregrine
+
+import (
+	"compress/flate"
+	"github.com/gobwas/ws"
+	"github.com/panjf2000/gnet/v2"
+	"github.com/pkg/errors"
+	"unicode/utf8"
+)
+
+var (
+	ErrInvalidCloseCode = errors.New("invalid close code")
+)
+
+// validCloseCode reports whether the code can be sent in a close frame (RFC 6455 7.4, IANA registry)
+func validCloseCode(code ws.StatusCode) bool {
+	switch {
+	case code >= 1000 && code <= 1003:
+		return true
+	case code >= 1007 && code <= 1014:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	default:
+		return false
+	}
+}
+
+// closeCode returns the close code of the error failed the conn
+func (s *Server) closeCode(err error) ws.StatusCode {
+	switch {
+	case errors.Is(err, ErrMessageTooBig):
+		return ws.StatusMessageTooBig
+	case errors.Is(err, ErrOverload):
+		return s.overloadCloseCode
+	}
+	if !s.strictProtocol {
+		return ws.StatusUnsupportedData
+	}
+
+	var (
+		protocolErr ws.ProtocolError
+		flateErr    flate.CorruptInputError
+	)
+	switch {
+	case errors.Is(err, ws.ErrProtocolInvalidUTF8), errors.As(err, &flateErr):
+		return ws.StatusInvalidFramePayloadData
+	case errors.As(err, &protocolErr):
+		return ws.StatusProtocolError
+	default:
+		return ws.StatusUnsupportedData
+	}
+}
+
+// checkMessage check the data message in strict protocol mode
+func (s *Server) checkMessage(opCode ws.OpCode, payload []byte) error {
+	if s.strictProtocol && opCode == ws.OpText && !utf8.Valid(payload) {
+		return ws.ErrProtocolInvalidUTF8
+	}
+	return nil
+}
+
+// echoClose answer the close frame of peer, it's called by the event-loop.
+//
+// in strict protocol mode, the close frame is validated and echoed with the status of peer
+func (s *Server) echoClose(conn *Conn, payload []byte) gnet.Action {
+	if !s.strictProtocol {
+		return gnet.Close
+	}
+
+	if len(payload) == 0 {
+		// no status code, echo an empty close frame
+		return s.replyClose(conn, ws.NewCloseFrame(nil))
+	}
+	if len(payload) == 1 {
+		return s.closeConn(conn, ws.StatusProtocolError, ErrInvalidCloseCode)
+	}
+
+	code, reason := ws.ParseCloseFrameData(payload)
+	switch {
+	case !validCloseCode(code):
+		return s.closeConn(conn, ws.StatusProtocolError, ErrInvalidCloseCode)
+	case !utf8.ValidString(reason):
+		return s.closeConn(conn, ws.StatusInvalidFramePayloadData, ws.ErrProtocolInvalidUTF8)
+	}
+	return s.replyClose(conn, ws.NewCloseFrame(ws.NewCloseFrameBody(code, "")))
+}
+
+// replyClose write the close frame after the messages received before the close frame of peer are answered,
+// the conn is closed once the close frame written.
+//
+// in DispatchOrdered mode, the close frame is written after the handlers of the conn returned,
+// it's queued in the mailbox of conn without the overload policy applied
+func (s *Server) replyClose(conn *Conn, frame ws.Frame) gnet.Action {
+	p := compileFrame(frame)
+	reply := func() {
+		if !conn.closing.CompareAndSwap(false, true) {
+			return
+		}
+		if err := conn.Conn.AsyncWrite(p, func(c gnet.Conn, _ error) error {
+			return c.Close()
+		}); err != nil {
+			_ = conn.Conn.Close()
+		}
+	}
+
+	if s.dispatchMode != DispatchOrdered {
+		reply()
+		return gnet.None
+	}
+	if conn.mailbox.push(reply) {
+		// no handler of the conn running, reply at once
+		conn.mailbox.drain()
+	}
+	return gnet.None
+}
@@ -0,0 +1,164 @@
+package peregrine
+
+import (
+	"bytes"
+	"github.com/gobwas/ws"
+	"github.com/pkg/errors"
+	"math"
+	"sync"
+	"time"
+)
+
+var (
+	ErrRateLimited = errors.New("rate limited")
+)
+
+// RateLimit the limit of inbound messages of a conn, the close frames are not limited.
+// the messages streamed to the StreamHandlerFunc while their frames arriving are exempt.
+// zero means unlimited
+type RateLimit struct {
+	// Messages the messages per second, MessageBurst the messages allowed at once (default Messages)
+	Messages     float64
+	MessageBurst int
+
+	// Bytes the payload bytes per second, ByteBurst the bytes allowed at once (default Bytes).
+	// the message larger than ByteBurst is allowed once the bucket is full
+	Bytes     float64
+	ByteBurst int
+}
+
+// RateLimitPolicy decides what to do with a message when the rate limit of conn exceeded
+type RateLimitPolicy uint8
+
+const (
+	// RateLimitDrop drop the message
+	RateLimitDrop RateLimitPolicy = iota
+
+	// RateLimitDelay stop reading the messages of conn until the rate limit allows,
+	// the frames arrived in the meantime stay in the inbound buffer
+	RateLimitDelay
+
+	// RateLimitClose drop the message and close the conn with StatusPolicyViolation (1008)
+	RateLimitClose
+)
+
+// rateLimiter is a token bucket of messages and bytes, it's goroutine-safe
+type rateLimiter struct {
+	mu       sync.Mutex
+	limit    RateLimit
+	messages float64
+	bytes    float64
+	last     time.Time
+}
+
+func (l *rateLimiter) set(limit RateLimit) {
+	if limit.MessageBurst <= 0 {
+		limit.MessageBurst = int(math.Ceil(limit.Messages))
+	}
+	if limit.ByteBurst <= 0 {
+		limit.ByteBurst = int(math.Ceil(limit.Bytes))
+	}
+
+	l.mu.Lock()
+	l.limit = limit
+	// the bucket is full after reset
+	l.messages, l.bytes = float64(limit.MessageBurst), float64(limit.ByteBurst)
+	l.last = time.Time{}
+	l.mu.Unlock()
+}
+
+func (l *rateLimiter) get() RateLimit {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit
+}
+
+// take a message of n bytes from the bucket, returns the wait until it's allowed if not allowed
+func (l *rateLimiter) take(n int, now time.Time) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	limit := l.limit
+	if limit.Messages <= 0 && limit.Bytes <= 0 {
+		return 0, true
+	}
+
+	if !l.last.IsZero() {
+		elapsed := now.Sub(l.last).Seconds()
+		l.messages = math.Min(l.messages+elapsed*limit.Messages, float64(limit.MessageBurst))
+		l.bytes = math.Min(l.bytes+elapsed*limit.Bytes, float64(limit.ByteBurst))
+	}
+	l.last = now
+
+	var (
+		size = math.Min(float64(n), float64(limit.ByteBurst))
+		wait float64
+	)
+	if limit.Messages > 0 && l.messages < 1 {
+		wait = (1 - l.messages) / limit.Messages
+	}
+	if limit.Bytes > 0 && l.bytes < size {
+		wait = math.Max(wait, (size-l.bytes)/limit.Bytes)
+	}
+	if wait > 0 {
+		return time.Duration(math.Ceil(wait * float64(time.Second))), false
+	}
+
+	if limit.Messages > 0 {
+		l.messages--
+	}
+	if limit.Bytes > 0 {
+		// the bucket may be in debt for the message larger than burst
+		l.bytes -= float64(n)
+	}
+	return 0, true
+}
+
+// SetRateLimit adjust the rate limit of conn at runtime, e.g. raise the limit of premium users.
+// zero means unlimited, it's goroutine-safe
+func (c *Conn) SetRateLimit(limit RateLimit) {
+	c.limiter.set(limit)
+}
+
+// RateLimit returns the rate limit of conn
+func (c *Conn) RateLimit() RateLimit {
+	return c.limiter.get()
+}
+
+// RateLimitedMessages returns the count of messages exceeded the rate limit
+func (s *Server) RateLimitedMessages() uint64 {
+	return s.limitedMessages.Load()
+}
+
+// rateLimited reports whether the message of conn exceeded the rate limit, it's called by the event-loop
+func (s *Server) rateLimited(conn *Conn, message message) (time.Duration, bool) {
+	if message.OpCode == ws.OpClose {
+		return 0, false
+	}
+	wait, ok := conn.limiter.take(len(message.Payload), time.Now())
+	if ok {
+		return 0, false
+	}
+
+	s.limitedMessages.Add(1)
+	// the packet takes over the payload of dropped message, the delayed message keeps its own
+	packet := s.acquirePacket(conn, message)
+	if s.rateLimitPolicy != RateLimitDrop {
+		packet.Request, packet.buf = bytes.Clone(message.Payload), nil
+	}
+	s.onRateLimitedHandler(conn, packet)
+	packet.Release()
+	return wait, true
+}
+
+// delay the messages of conn until wait elapsed, err the decode error after the messages.
+// the conn is woken up to handle the delayed messages before decoding more frames
+func (s *Server) delay(conn *Conn, messages []message, err error, wait time.Duration) {
+	conn.delayed, conn.delayedErr = messages, err
+	conn.delayUntil = time.Now().Add(wait)
+	time.AfterFunc(wait, func() {
+		if !conn.released.Load() {
+			_ = conn.Conn.Wake(nil)
+		}
+	})
+}
@@ -0,0 +1,195 @@
+package peregrine
+
+import (
+	"github.com/gobwas/ws"
+	"github.com/panjf2000/gnet/v2"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	var (
+		l   rateLimiter
+		now = time.Now()
+	)
+	l.set(RateLimit{Messages: 10, MessageBurst: 2, Bytes: 100})
+
+	for i := 0; i < 2; i++ {
+		if _, ok := l.take(10, now); !ok {
+			t.Fatalf("message %d in burst not allowed", i)
+		}
+	}
+	wait, ok := l.take(10, now)
+	if ok || wait != 100*time.Millisecond {
+		t.Fatalf("expect wait 100ms, got: %v, %v", wait, ok)
+	}
+	if _, ok = l.take(10, now.Add(wait)); !ok {
+		t.Fatal("message not allowed after wait")
+	}
+
+	// the message larger than burst is allowed once the bucket is full, then the bucket is in debt
+	now = now.Add(time.Second)
+	if _, ok = l.take(1000, now); !ok {
+		t.Fatal("message larger than burst not allowed with full bucket")
+	}
+	if wait, ok = l.take(1, now); ok || wait < 9*time.Second {
+		t.Fatalf("expect wait for the debt, got: %v, %v", wait, ok)
+	}
+
+	l.set(RateLimit{})
+	if _, ok = l.take(1000, now); !ok {
+		t.Fatal("unlimited not allowed")
+	}
+}
+
+// sendMessages write the text messages to c and call OnTraffic
+func sendMessages(t *testing.T, s *Server, c *mockConn, n int) gnet.Action {
+	for i := 0; i < n; i++ {
+		c.inbound.Write(compileClientFrame(t, ws.NewTextFrame([]byte("peregrine"))))
+	}
+	return s.OnTraffic(c)
+}
+
+func TestServer_RateLimit(t *testing.T) {
+	var (
+		handled atomic.Int32
+		limited atomic.Int32
+		limit   = RateLimit{Messages: 1, MessageBurst: 2}
+	)
+	newServer := func(policy RateLimitPolicy) *Server {
+		handled.Store(0)
+		limited.Store(0)
+		return NewServer(
+			"tcp://127.0.0.1:0",
+			WithDispatchMode(DispatchOrdered),
+			WithRateLimit(limit, policy),
+			WithHandler(func(_ *Packet) { handled.Add(1) }),
+			WithOnRateLimitedHandler(func(_ *Conn, _ *Packet) { limited.Add(1) }),
+		)
+	}
+	waitHandled := func(n int32) {
+		deadline := time.Now().Add(time.Second)
+		for handled.Load() != n {
+			if time.Now().After(deadline) {
+				t.Fatalf("expect %d messages handled, got: %d", n, handled.Load())
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	t.Run("drop", func(t *testing.T) {
+		s := newServer(RateLimitDrop)
+		c, conn := upgradeMockConn(t, s)
+		if action := sendMessages(t, s, c, 5); action != gnet.None {
+			t.Fatalf("unexpected action: %v", action)
+		}
+		waitHandled(2)
+		if limited.Load() != 3 || s.RateLimitedMessages() != 3 {
+			t.Fatalf("expect 3 messages limited, got: %d", limited.Load())
+		}
+
+		// premium user
+		conn.SetRateLimit(RateLimit{Messages: 1000, MessageBurst: 1000})
+		if action := sendMessages(t, s, c, 10); action != gnet.None {
+			t.Fatalf("unexpected action: %v", action)
+		}
+		waitHandled(12)
+	})
+
+	t.Run("close", func(t *testing.T) {
+		s := newServer(RateLimitClose)
+		c, _ := upgradeMockConn(t, s)
+		if action := sendMessages(t, s, c, 3); action != gnet.Close {
+			t.Fatalf("conn not closed, action: %v", action)
+		}
+		frame, err := ws.ReadFrame(&c.outbound)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code, _ := ws.ParseCloseFrameData(frame.Payload); frame.Header.OpCode != ws.OpClose || code != ws.StatusPolicyViolation {
+			t.Fatalf("unexpected close frame: %v", frame)
+		}
+		waitHandled(2)
+	})
+
+	t.Run("delay", func(t *testing.T) {
+		s := newServer(RateLimitDelay)
+		c, _ := upgradeMockConn(t, s)
+		c.woken = make(chan struct{}, 1)
+		if action := sendMessages(t, s, c, 3); action != gnet.None {
+			t.Fatalf("unexpected action: %v", action)
+		}
+		waitHandled(2)
+
+		// the frames arrived during the delay stay in the inbound buffer
+		c.inbound.Write(compileClientFrame(t, ws.NewTextFrame([]byte("peregrine"))))
+		buffered := c.inbound.Len()
+
+		// the traffic during the delay never counts the delayed message again
+		if action := s.OnTraffic(c); action != gnet.None || c.inbound.Len() != buffered {
+			t.Fatalf("frames decoded during the delay, action: %v", action)
+		}
+		if limited.Load() != 1 || s.RateLimitedMessages() != 1 {
+			t.Fatalf("delayed message counted again: %d", limited.Load())
+		}
+
+		start := time.Now()
+		select {
+		case <-c.woken:
+		case <-time.After(2 * time.Second):
+			t.Fatal("conn not woken up")
+		}
+		if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+			t.Fatalf("woken up too early: %v", elapsed)
+		}
+		if c.inbound.Len() != buffered {
+			t.Fatal("frames decoded during the delay")
+		}
+
+		// the delayed message is handled, the last message is delayed again
+		if action := s.OnTraffic(c); action != gnet.None {
+			t.Fatalf("unexpected action: %v", action)
+		}
+		waitHandled(3)
+		if c.inbound.Len() != 0 || limited.Load() != 2 {
+			t.Fatalf("unexpected state, buffered: %d, limited: %d", c.inbound.Len(), limited.Load())
+		}
+	})
+}
+
+func TestServer_RateLimitedRetain(t *testing.T) {
+	var retained []*Packet
+	s := NewServer(
+		"tcp://127.0.0.1:0",
+		WithRateLimit(RateLimit{Messages: 1, MessageBurst: 1}, RateLimitDrop),
+		WithHandler(func(_ *Packet) {}),
+		WithOnRateLimitedHandler(func(_ *Conn, packet *Packet) {
+			packet.Retain()
+			retained = append(retained, packet)
+		}),
+	)
+	c, _ := upgradeMockConn(t, s)
+	for i := 0; i < 8; i++ {
+		c.inbound.Write(compileClientFrame(t, ws.NewTextFrame([]byte("peregrine-"+strconv.Itoa(i)))))
+	}
+	s.OnTraffic(c)
+	if len(retained) != 7 {
+		t.Fatalf("expect 7 messages limited, got: %d", len(retained))
+	}
+
+	// the payload buffers of the released messages are reused
+	for i := 0; i < 8; i++ {
+		c.inbound.Write(compileClientFrame(t, ws.NewTextFrame([]byte("overwritten"))))
+	}
+	s.OnTraffic(c)
+	for i, packet := range retained[:7] {
+		if expect := "peregrine-" + strconv.Itoa(i+1); string(packet.Request) != expect {
+			t.Fatalf("retained packet reused, expect %s, got: %s", expect, packet.Request)
+		}
+	}
+	for _, packet := range retained {
+		packet.Release()
+	}
+}
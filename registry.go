@@ -0,0 +1,93 @@
+package peregrine
+
+import (
+	"github.com/gobwas/ws"
+	"sync"
+)
+
+// registry all upgraded connections of the server, keyed by Conn.ID
+type registry struct {
+	rwm   sync.RWMutex
+	conns map[string]*Conn
+}
+
+func (r *registry) add(conn *Conn) {
+	r.rwm.Lock()
+	if r.conns == nil {
+		r.conns = make(map[string]*Conn)
+	}
+	r.conns[conn.ID] = conn
+	r.rwm.Unlock()
+}
+
+func (r *registry) remove(conn *Conn) {
+	r.rwm.Lock()
+	delete(r.conns, conn.ID)
+	r.rwm.Unlock()
+}
+
+func (r *registry) get(id string) (*Conn, bool) {
+	r.rwm.RLock()
+	conn, found := r.conns[id]
+	r.rwm.RUnlock()
+	return conn, found
+}
+
+func (r *registry) len() int {
+	r.rwm.RLock()
+	defer r.rwm.RUnlock()
+	return len(r.conns)
+}
+
+// snapshot copy the connections, so the callers never hold the lock while calling user functions
+func (r *registry) snapshot() []*Conn {
+	r.rwm.RLock()
+	conns := make([]*Conn, 0, len(r.conns))
+	for _, conn := range r.conns {
+		conns = append(conns, conn)
+	}
+	r.rwm.RUnlock()
+	return conns
+}
+
+// Conn returns the upgraded connection by Conn.ID
+func (s *Server) Conn(id string) (*Conn, bool) {
+	return s.registry.get(id)
+}
+
+// Len returns the count of upgraded connections
+func (s *Server) Len() int {
+	return s.registry.len()
+}
+
+// Range calls fn sequentially for each upgraded connection, if fn returns false, Range stops the iteration.
+//
+// the connections opened or closed during the iteration may or may not be visited
+func (s *Server) Range(fn func(conn *Conn) bool) {
+	for _, conn := range s.registry.snapshot() {
+		if !fn(conn) {
+			return
+		}
+	}
+}
+
+// Broadcast write a message to each upgraded connection which filter (could be nil) returns true,
+// returns the count of connections the message is written to.
+//
+// the message is encoded once as a PreparedMessage
+func (s *Server) Broadcast(opCode ws.OpCode, p []byte, filter func(conn *Conn) bool) int {
+	var (
+		pm    = NewPreparedMessage(opCode, p)
+		count int
+	)
+	s.Range(func(conn *Conn) bool {
+		if filter != nil && !filter(conn) {
+			return true
+		}
+		if conn.WritePreparedMessage(pm) == nil {
+			count++
+		}
+		return true
+	})
+	return count
+}
@@ -0,0 +1,74 @@
+package peregrine
+
+import (
+	"bytes"
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/panjf2000/gnet/v2"
+	"testing"
+)
+
+const testHandshake = "GET / HTTP/1.1\r\n" +
+	"Host: 127.0.0.1\r\n" +
+	"Upgrade: websocket\r\n" +
+	"Connection: Upgrade\r\n" +
+	"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+	"Sec-WebSocket-Version: 13\r\n\r\n"
+
+// upgradeMockConn returns a mockConn upgraded by the server, the handshake response is discarded
+func upgradeMockConn(t testing.TB, s *Server) (*mockConn, *Conn) {
+	c := &mockConn{}
+	c.inbound.WriteString(testHandshake)
+	if action := s.OnTraffic(c); action != gnet.None {
+		t.Fatalf("unexpected action: %v", action)
+	}
+	c.outbound.Reset()
+
+	conn, ok := c.Context().(*Conn)
+	if !ok || !conn.readyUpgraded.Load() {
+		t.Fatal("conn not upgraded")
+	}
+	return c, conn
+}
+
+func TestServer_Registry(t *testing.T) {
+	s := NewServer("tcp://127.0.0.1:0")
+
+	c1, conn1 := upgradeMockConn(t, s)
+	c2, conn2 := upgradeMockConn(t, s)
+
+	if conn, ok := s.Conn(conn1.ID); !ok || conn != conn1 {
+		t.Fatal("conn not found by id")
+	}
+	if s.Len() != 2 {
+		t.Fatalf("expect 2 conns, got: %d", s.Len())
+	}
+
+	visited := 0
+	s.Range(func(_ *Conn) bool {
+		visited++
+		return false
+	})
+	if visited != 1 {
+		t.Fatalf("Range not stopped, visited: %d", visited)
+	}
+
+	// broadcast to the conns except conn1
+	if n := s.Broadcast(ws.OpText, []byte("peregrine"), func(conn *Conn) bool {
+		return conn != conn1
+	}); n != 1 {
+		t.Fatalf("expect broadcast to 1 conn, got: %d", n)
+	}
+	if c1.outbound.Len() != 0 {
+		t.Fatal("filtered conn received the broadcast")
+	}
+	message, err := wsutil.ReadServerText(&c2.outbound)
+	if err != nil || !bytes.Equal(message, []byte("peregrine")) {
+		t.Fatalf("unexpected broadcast message: %s, %v", message, err)
+	}
+
+	s.OnClose(c2, nil)
+	if _, ok := s.Conn(conn2.ID); ok || s.Len() != 1 {
+		t.Fatal("closed conn not removed")
+	}
+}
@@ -0,0 +1,102 @@
+package peregrine
+
+import (
+	"github.com/gobwas/ws"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// route is a path pattern, the segments prefixed by ':' are parameters
+type route struct {
+	segments []string
+	// static the count of static segments, the route has more static segments is preferred
+	static  int
+	handler HandlerFunc
+}
+
+func newRoute(pattern string, handler HandlerFunc) route {
+	r := route{
+		segments: splitPath(pattern),
+		handler:  handler,
+	}
+	for _, segment := range r.segments {
+		if !strings.HasPrefix(segment, ":") {
+			r.static++
+		}
+	}
+	return r
+}
+
+// match reports whether the segments of path matched the route, the parameters are returned
+func (r route) match(segments []string) (map[string]string, bool) {
+	if len(segments) != len(r.segments) {
+		return nil, false
+	}
+
+	var params map[string]string
+	for i, segment := range r.segments {
+		if name, ok := strings.CutPrefix(segment, ":"); ok {
+			if segments[i] == "" {
+				return nil, false
+			}
+			if params == nil {
+				params = make(map[string]string)
+			}
+			params[name] = segments[i]
+			continue
+		}
+		if segment != segments[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+func splitPath(path string) []string {
+	return strings.Split(strings.Trim(path, "/"), "/")
+}
+
+// Route register the handler of the endpoint, the conns requested the path are handled by the handler.
+// the pattern can contain parameters like "/ws/feed/:id", which can be read by Conn.Param.
+//
+// once any route registered, the handshake of unknown path is rejected with 404.
+// the handler of route takes precedence over the handlers of WithSubprotocols, the subprotocol is still negotiated
+// and can be read by Conn.Subprotocol. Route should be called before ListenAndServe
+func (s *Server) Route(pattern string, handler HandlerFunc) {
+	s.routes = append(s.routes, newRoute(pattern, handler))
+}
+
+// routeRequest parse the request uri of handshake, the conn is attached the path, query and the handler of route
+func (s *Server) routeRequest(conn *Conn, uri []byte) error {
+	// the uri is copied, it's a slice of inbound buffer
+	u, err := url.ParseRequestURI(string(uri))
+	if err != nil {
+		return ws.RejectConnectionError(
+			ws.RejectionStatus(http.StatusBadRequest),
+			ws.RejectionReason(err.Error()),
+		)
+	}
+	conn.Path = u.Path
+	conn.Query = u.Query()
+
+	if len(s.routes) == 0 {
+		return nil
+	}
+
+	var (
+		segments = splitPath(u.Path)
+		matched  *route
+	)
+	for i := range s.routes {
+		if params, ok := s.routes[i].match(segments); ok && (matched == nil || s.routes[i].static > matched.static) {
+			matched = &s.routes[i]
+			conn.params = params
+		}
+	}
+	if matched == nil {
+		return ws.RejectConnectionError(ws.RejectionStatus(http.StatusNotFound))
+	}
+	conn.handler = matched.handler
+	return nil
+}
@@ -0,0 +1,77 @@
+package peregrine
+
+import (
+	"bytes"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/panjf2000/gnet/v2"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServer_Route(t *testing.T) {
+	handled := make(chan string, 1)
+	route := func(name string) HandlerFunc {
+		return func(packet *Packet) {
+			handled <- name + ":" + packet.Conn.Param("id")
+		}
+	}
+
+	s := NewServer("tcp://127.0.0.1:0", WithHandler(route("default")))
+	s.Route("/ws/chat", route("chat"))
+	s.Route("/ws/feed/:id", route("feed"))
+	s.Route("/ws/feed/latest", route("latest"))
+
+	tests := []struct {
+		uri    string
+		status int
+		expect string
+		query  string
+	}{
+		{uri: "/ws/chat", status: http.StatusSwitchingProtocols, expect: "chat:"},
+		{uri: "/ws/chat/?room=1", status: http.StatusSwitchingProtocols, expect: "chat:", query: "1"},
+		{uri: "/ws/feed/42?room=2", status: http.StatusSwitchingProtocols, expect: "feed:42", query: "2"},
+		{uri: "/ws/feed/latest", status: http.StatusSwitchingProtocols, expect: "latest:"},
+		{uri: "/ws/feed", status: http.StatusNotFound},
+		{uri: "/ws/feed/42/comments", status: http.StatusNotFound},
+		{uri: "/", status: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		c := &mockConn{}
+		c.inbound.WriteString(strings.Replace(testHandshake, "GET / ", "GET "+tt.uri+" ", 1))
+		action := s.OnTraffic(c)
+
+		resp, _ := readHandshakeResponse(t, c)
+		if resp.StatusCode != tt.status {
+			t.Fatalf("%s: expect status %d, got: %d", tt.uri, tt.status, resp.StatusCode)
+		}
+		if tt.status != http.StatusSwitchingProtocols {
+			if action != gnet.Close {
+				t.Fatalf("%s: conn not closed", tt.uri)
+			}
+			continue
+		}
+
+		conn := c.Context().(*Conn)
+		if conn.Path != strings.Split(tt.uri, "?")[0] || conn.Query.Get("room") != tt.query {
+			t.Fatalf("%s: unexpected path: %s, query: %v", tt.uri, conn.Path, conn.Query)
+		}
+
+		buf := &bytes.Buffer{}
+		_ = wsutil.WriteClientText(buf, []byte("peregrine"))
+		c.inbound.Write(buf.Bytes())
+		if action = s.OnTraffic(c); action != gnet.None {
+			t.Fatalf("unexpected action: %v", action)
+		}
+
+		select {
+		case got := <-handled:
+			if got != tt.expect {
+				t.Fatalf("%s: expect handled by %s, got: %s", tt.uri, tt.expect, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("packet not handled")
+		}
+	}
+}
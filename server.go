@@ -1,30 +1,103 @@
 package peregrine
 
 import (
+	"bytes"
 	"context"
 	"github.com/gobwas/ws"
-	"github.com/gobwas/ws/wsutil"
-	"github.com/jellydator/ttlcache/v3"
+	"github.com/gobwas/ws/wsflate"
 	"github.com/panjf2000/ants/v2"
 	"github.com/panjf2000/gnet/v2"
 	"github.com/pkg/errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Server struct {
-	timeout time.Duration
-
 	addr string
 
 	ctx        context.Context
 	engine     gnet.Engine
 	workerPool *ants.Pool
 	upgrader   *ws.Upgrader
-	connTable  *ttlcache.Cache[string, gnet.Conn]
+	registry   registry
 	logger     Logger
 
-	onCloseHandler OnCloseHandlerFunc
-	onPingHandler  OnPingHandlerFunc
+	// wheel check the timeouts of conns, advanced by OnTick
+	wheel    *timingWheel
+	timeouts timeouts
+
+	// dispatchMode how messages are submitted to the workerPool
+	dispatchMode DispatchMode
+
+	// overloadPolicy applied when the workerPool is saturated
+	overloadPolicy    OverloadPolicy
+	overloadCloseCode ws.StatusCode
+	overloadQueue     chan func()
+	queueMu           sync.RWMutex
+	queueClosed       bool
+	dropped           atomic.Uint64
+	queued            atomic.Uint64
+
+	// inflight the count of dispatched tasks not done
+	inflight atomic.Int64
+
+	// streamHandler not nil in streaming mode, streamWindow the payload bytes buffered of a streaming message
+	streamHandler StreamHandlerFunc
+	streamWindow  int
+
+	// maxMessageSize the max size of inbound message, zero means unlimited
+	maxMessageSize int64
+
+	// strictProtocol enable the strict checks of RFC 6455
+	strictProtocol bool
+
+	// writeCoalescing batch the frames written to a conn until the event-loop flush them
+	writeCoalescing bool
+
+	// maxOutbound the max pending outbound bytes of a conn, zero means unlimited
+	maxOutbound           int
+	slowConsumerPolicy    SlowConsumerPolicy
+	slowConsumerCloseCode ws.StatusCode
+	droppedFrames         atomic.Uint64
+
+	// compression not nil if permessage-deflate enabled
+	compression *CompressionOptions
+
+	// shutdown set once Shutdown called
+	shutdown          atomic.Bool
+	shutdownCloseCode ws.StatusCode
+	shutdownReason    string
+
+	onOpenHandler         OnOpenHandlerFunc
+	onHandshakeHandler    OnHandshakeHandlerFunc
+	onUpgradeErrorHandler OnUpgradeErrorHandlerFunc
+	onCloseHandler        OnCloseHandlerFunc
+	onPingHandler         OnPingHandlerFunc
+	onPongHandler         OnPongHandlerFunc
+
+	onOverloadHandler     OnOverloadHandlerFunc
+	onRateLimitedHandler  OnRateLimitedHandlerFunc
+	onSlowConsumerHandler OnSlowConsumerHandlerFunc
+
+	// rateLimit the default rate limit of conns
+	rateLimit       RateLimit
+	rateLimitPolicy RateLimitPolicy
+	limitedMessages atomic.Uint64
+
+	// limits the count of conns
+	limits connLimits
+
+	// origins the allowlist of Origin header compiled from allowedOrigins, nil means any origin allowed
+	allowedOrigins []string
+	origins        *origins
+
+	// routes the endpoints registered by Route
+	routes []route
+
+	// subprotocols the handlers of subprotocols, negotiated by Sec-WebSocket-Protocol
+	subprotocols map[string]HandlerFunc
 
 	handler HandlerFunc
 }
@@ -44,18 +117,46 @@ func (s *Server) withDefault() {
 		})(s)
 	}
 
+	if s.overloadCloseCode == 0 {
+		WithOverloadCloseCode(StatusTryAgainLater)(s)
+	}
+
+	if s.slowConsumerCloseCode == 0 {
+		WithSlowConsumerCloseCode(StatusTryAgainLater)(s)
+	}
+
+	if s.overloadQueue == nil {
+		WithOverloadQueueSize(1024)(s)
+	}
+
+	if s.shutdownCloseCode == 0 {
+		WithShutdownClose(ws.StatusGoingAway, "server shutdown")(s)
+	}
+
 	if s.upgrader == nil {
 		WithUpgrader(emptyUpgrader)(s)
 	}
 
-	if s.connTable == nil {
-		WithConnTimeout(15 * time.Second)(s)
+	if s.wheel == nil {
+		WithTimeoutTick(100 * time.Millisecond)(s)
 	}
 
 	if s.logger == nil {
 		WithLogger(DefaultLogger)(s)
 	}
 
+	if s.allowedOrigins != nil {
+		s.origins = newOrigins(s.allowedOrigins, s.logger)
+	}
+
+	if s.onOpenHandler == nil {
+		WithOnOpenHandler(EmptyOnOpenHandler)(s)
+	}
+
+	if s.onUpgradeErrorHandler == nil {
+		WithOnUpgradeErrorHandler(EmptyOnUpgradeErrorHandler)(s)
+	}
+
 	if s.onCloseHandler == nil {
 		WithOnCloseHandler(EmptyOnCloseHandler)(s)
 	}
@@ -64,66 +165,103 @@ func (s *Server) withDefault() {
 		WithOnPingHandler(DefaultOnPingHandler)(s)
 	}
 
+	if s.onPongHandler == nil {
+		WithOnPongHandler(EmptyOnPongHandler)(s)
+	}
+
+	if s.onOverloadHandler == nil {
+		WithOnOverloadHandler(EmptyOnOverloadHandler)(s)
+	}
+
+	if s.streamWindow <= 0 {
+		WithStreamWindow(defaultStreamWindow)(s)
+	}
+
+	if s.onSlowConsumerHandler == nil {
+		WithOnSlowConsumerHandler(EmptyOnSlowConsumerHandler)(s)
+	}
+
+	if s.onRateLimitedHandler == nil {
+		WithOnRateLimitedHandler(EmptyOnRateLimitedHandler)(s)
+	}
+
 	if s.handler == nil {
 		WithHandler(EmptyHandler)(s)
 	}
 }
 
+// CloseConn write a close frame to conn and close it after the frame written, it's goroutine-safe.
+//
+// reason is passed to the OnCloseHandlerFunc
 func (s *Server) CloseConn(conn *Conn, statusCode ws.StatusCode, reason error) error {
-	defer s.onCloseHandler(conn, reason)
-	return ws.WriteFrame(conn, ws.NewCloseFrame(ws.NewCloseFrameBody(statusCode, func() string {
+	conn.setCloseReason(reason)
+	return conn.WriteClose(statusCode, func() string {
 		if reason != nil {
 			return reason.Error()
 		}
 		return ""
-	}())))
+	}())
 }
 
-func (s *Server) StartTimeoutScanner() {
-	// on connect timeout handler
-	s.connTable.OnEviction(func(
-		_ context.Context,
-		reason ttlcache.EvictionReason,
-		item *ttlcache.Item[string, gnet.Conn],
-	) {
-		upgraderConn, ok := item.Value().Context().(*Conn)
-		if !ok {
-			_ = item.Value().Close()
-			return
+// closeConn same as CloseConn, but write the close frame synchronously,
+// it should only be called by the event-loop, the returned action closes the conn
+func (s *Server) closeConn(conn *Conn, statusCode ws.StatusCode, reason error) gnet.Action {
+	conn.setCloseReason(reason)
+	if conn.closing.CompareAndSwap(false, true) {
+		var text string
+		if reason != nil {
+			text = reason.Error()
 		}
+		_ = ws.WriteFrame(conn.Conn, ws.NewCloseFrame(ws.NewCloseFrameBody(statusCode, text)))
+	}
+	return gnet.Close
+}
 
-		// invalid eviction, put back ttlcache
-		if upgraderConn.LastActive.Load() > time.Now().Add(-s.timeout).Unix() {
-			s.connTable.Set(item.Key(), item.Value(), ttlcache.DefaultTTL)
-			return
+// UseOnHandshakeHandler append a handler called after the current OnHandshakeHandlerFunc succeeded,
+// it should be called before ListenAndServe
+func (s *Server) UseOnHandshakeHandler(handler OnHandshakeHandlerFunc) {
+	prev := s.onHandshakeHandler
+	if prev == nil {
+		s.onHandshakeHandler = handler
+		return
+	}
+	s.onHandshakeHandler = func(conn *Conn, r *http.Request) error {
+		if err := prev(conn, r); err != nil {
+			return err
 		}
+		return handler(conn, r)
+	}
+}
 
-		_ = s.CloseConn(upgraderConn, ws.StatusGoingAway, errors.New("timeout"))
-	})
-
-	// start monitor connect ttl
-	go s.connTable.Start()
-	go func() {
-		time.Sleep(1 * time.Hour)
-		s.connTable.DeleteExpired()
-	}()
+// UseOnCloseHandler append a handler called after the current OnCloseHandlerFunc,
+// it should be called before ListenAndServe
+func (s *Server) UseOnCloseHandler(handler OnCloseHandlerFunc) {
+	prev := s.onCloseHandler
+	s.onCloseHandler = func(conn *Conn, err error) {
+		prev(conn, err)
+		handler(conn, err)
+	}
 }
 
-func (s *Server) ConnTableLen() int {
-	return s.connTable.Len()
+func (s *Server) maxHandshakeSize() int {
+	if s.upgrader.ReadBufferSize != 0 {
+		return s.upgrader.ReadBufferSize
+	}
+	return ws.DefaultServerReadBufferSize
 }
 
 func (s *Server) CountConnections() int {
 	return s.engine.CountConnections()
 }
 
+// Stop the engine immediately, the conns are closed without close frame, see Shutdown
 func (s *Server) Stop(ctx context.Context) error {
 	return s.engine.Stop(ctx)
 }
 
 func (s *Server) ListenAndServe(opts ...gnet.Option) error {
-	s.StartTimeoutScanner()
-	return gnet.Run(s, s.addr, append(opts, gnet.WithLogger(s.logger))...)
+	s.startOverloadQueue()
+	return gnet.Run(s, s.addr, append(opts, gnet.WithLogger(s.logger), gnet.WithTicker(true))...)
 }
 
 // ---- gnet event handler ----
@@ -134,36 +272,59 @@ func (s *Server) OnBoot(eng gnet.Engine) gnet.Action {
 	return gnet.None
 }
 
-func (s *Server) OnShutdown(e gnet.Engine) {
-	if err := e.Stop(s.ctx); err != nil {
-		s.logger.Errorf("gnet.OnShutdown error: %s", err)
-	}
+func (s *Server) OnShutdown(_ gnet.Engine) {
+	s.logger.Infof("[+] Shutdown addr: %s", s.addr)
+}
+
+// newConn returns the Conn of c, the context of it is derived from the server context
+func (s *Server) newConn(c gnet.Conn) *Conn {
+	conn := NewUpgraderConn(c)
+	conn.ctx, conn.cancelCause = context.WithCancelCause(s.ctx)
+	return conn
 }
 
 func (s *Server) OnOpen(c gnet.Conn) ([]byte, gnet.Action) {
+	if s.shutdown.Load() {
+		return nil, gnet.Close
+	}
+
+	conn := s.newConn(c)
+	c.SetContext(conn)
+	if out, action := s.acquireConn(conn); action != gnet.None {
+		return out, action
+	}
+
 	// monitor conn timeout
-	s.connTable.Set(c.RemoteAddr().String(), c, ttlcache.DefaultTTL)
+	s.watch(conn)
 	return nil, gnet.None
 }
 
-func (s *Server) OnClose(c gnet.Conn, _ error) gnet.Action {
-	// conn closed, remove conn in monitor list
-	if addr := c.RemoteAddr(); addr != nil {
-		s.connTable.Delete(addr.String())
+func (s *Server) OnClose(c gnet.Conn, err error) gnet.Action {
+	if conn, ok := c.Context().(*Conn); ok {
+		// conn closed, remove conn in monitor list
+		conn.released.Store(true)
+		s.unwatch(conn)
+		s.registry.remove(conn)
+		s.releaseConn(conn)
+		if conn.stream != nil {
+			conn.stream.abort()
+		}
+		conn.discardHeld()
+		reason := conn.closeReason(err)
+		conn.cancel(reason)
+		s.onCloseHandler(conn, reason)
 	}
 	return gnet.None
 }
 
 func (s *Server) OnTick() (time.Duration, gnet.Action) {
-	return 0, gnet.None
+	s.wheel.advance(s.wheel.now())
+	return s.wheel.tick, gnet.None
 }
 
 func (s *Server) OnTraffic(c gnet.Conn) gnet.Action {
-	// reset conn ttl
-	s.connTable.Touch(c.RemoteAddr().String())
-
 	if c.Context() == nil {
-		c.SetContext(NewUpgraderConn(c))
+		c.SetContext(s.newConn(c))
 	}
 
 	conn, ok := c.Context().(*Conn)
@@ -171,63 +332,213 @@ func (s *Server) OnTraffic(c gnet.Conn) gnet.Action {
 		s.logger.Errorf("[-] invalid context, remote addr: %s", c.RemoteAddr())
 		return gnet.None
 	}
+	conn.keepAlive(s.wheel.now())
+
+	// close frame has been written, ignore the rest of traffic
+	if conn.closing.Load() {
+		return s.awaitClose(c, conn)
+	}
 
 	// trying upgrader conn
 	if !conn.readyUpgraded.Load() {
-		handshake, err := s.upgrader.Upgrade(conn)
+		request, ready := peekHandshake(c)
+		if !ready && len(request) < s.maxHandshakeSize() {
+			// waiting for the rest of handshake request
+			return gnet.None
+		}
+
+		upgrader := *s.upgrader
+		if len(s.subprotocols) != 0 {
+			upgrader.Protocol = s.negotiateSubprotocol
+		}
+		onRequest := upgrader.OnRequest
+		upgrader.OnRequest = func(uri []byte) error {
+			if err := s.checkShutdown(); err != nil {
+				return err
+			}
+			if err := s.routeRequest(conn, uri); err != nil {
+				return err
+			}
+			if onRequest != nil {
+				return onRequest(uri)
+			}
+			return nil
+		}
+		if s.origins != nil {
+			upgrader.OnHeader = s.checkOrigin(c, upgrader.OnHeader)
+		}
+		if s.onHandshakeHandler != nil {
+			onBeforeUpgrade := upgrader.OnBeforeUpgrade
+			upgrader.OnBeforeUpgrade = func() (ws.HandshakeHeader, error) {
+				if err := s.handshake(conn, request); err != nil {
+					return nil, err
+				}
+				if onBeforeUpgrade != nil {
+					return onBeforeUpgrade()
+				}
+				return nil, nil
+			}
+		}
+		if s.compression != nil {
+			upgrader.Negotiate = s.compression.negotiate(func(params wsflate.Parameters) {
+				conn.useCompression(*s.compression, params)
+			})
+		}
+
+		handshake, err := upgrader.Upgrade(&handshakeReadWriter{
+			Reader: bytes.NewReader(request),
+			Writer: c,
+		})
 		if err != nil {
+			// the handshake response has been written by upgrader
 			s.logger.Errorf("[-] upgrade error: %s, remote: %s\n", err.Error(), c.RemoteAddr())
-			_ = s.CloseConn(conn, ws.StatusProtocolError, err)
+			conn.setCloseReason(err)
+			s.onUpgradeErrorHandler(conn, err)
 			return gnet.Close
 		}
+		_, _ = c.Discard(len(request))
 
 		conn.readyUpgraded.Store(true)
 		conn.Header = handshake.Header
-		conn.keepAlive()
+		conn.SetRateLimit(s.rateLimit)
+		conn.decoder.maxSize = s.maxMessageSize
+		if s.writeCoalescing || s.maxOutbound > 0 {
+			// the outbound frames are queued by the coalescer to apply the max outbound buffer
+			conn.coalescer = newCoalescer(conn, s)
+		}
+		if s.streamHandler != nil {
+			conn.stream = &streamDispatcher{s: s, conn: conn}
+			conn.decoder.sink = conn.stream
+		}
+		conn.Subprotocol = handshake.Protocol
+		if conn.handler == nil {
+			// no route matched
+			conn.handler = s.handlerOf(handshake.Protocol)
+		}
+		s.registry.add(conn)
+		s.upgraded(conn)
+
+		if err = s.onOpenHandler(conn); err != nil {
+			s.logger.Warnf("[-] conn rejected: %s, remote: %s", err, c.RemoteAddr())
+			code := ws.StatusPolicyViolation
+			var closeErr *CloseError
+			if errors.As(err, &closeErr) {
+				code = closeErr.Code
+			}
+			return s.closeConn(conn, code, err)
+		}
+
+		// Shutdown started during the upgrade, and may have missed the conn
+		if s.shutdown.Load() {
+			conn.setCloseReason(ErrServerClosed)
+			_ = conn.writeCloseFrame(s.shutdownCloseCode, s.shutdownReason)
+			return gnet.None
+		}
+
+		// no more frames arrived with the handshake request
+		if c.InboundBuffered() == 0 {
+			return gnet.None
+		}
+	}
+
+	// the traffic during the delay is left in the inbound buffer, the delayed messages are counted once
+	if conn.delayed != nil && time.Now().Before(conn.delayUntil) {
 		return gnet.None
 	}
 
-	// waiting client message
-	messages, err := wsutil.ReadClientMessage(conn, nil)
-	if err != nil {
-		s.logger.Errorf("[-] read client message error: %s, remote: %s\n", err.Error(), c.RemoteAddr())
-		_ = s.CloseConn(conn, ws.StatusUnsupportedData, err)
-		return gnet.Close
+	// decode the complete frames in the inbound buffer
+	// the messages decoded before the error are handled
+	messages, err := conn.delayed, conn.delayedErr
+	delayed := messages != nil
+	if !delayed {
+		messages, err = conn.decoder.Decode(c)
 	}
+	conn.delayed, conn.delayedErr = nil, nil
 
 	// handle client message
-	for _, message := range messages {
+	for i, message := range messages {
+		if wait, limited := s.rateLimited(conn, message); limited {
+			switch s.rateLimitPolicy {
+			case RateLimitDelay:
+				s.delay(conn, messages[i:], err, wait)
+				return gnet.None
+			case RateLimitClose:
+				return s.closeConn(conn, ws.StatusPolicyViolation, ErrRateLimited)
+			default:
+				// the payload released by the packet of rate limited handler
+				continue
+			}
+		}
+
 		switch message.OpCode {
 		case ws.OpPing:
+			// the pong must carry the same payload of ping (RFC 6455 5.5.3)
+			_ = conn.WritePong(message.Payload)
 			// async handle
-			_ = s.workerPool.Submit(func() {
+			if action := s.dispatch(&Packet{
+				OpCode:  message.OpCode,
+				Request: message.Payload,
+				Conn:    conn,
+			}, func() {
 				s.onPingHandler(conn)
-			})
-			conn.keepAlive()
-		case ws.OpText, ws.OpBinary:
+			}); action != gnet.None {
+				return action
+			}
+		case ws.OpPong:
+			s.pong(conn, message.Payload)
 			// async handle
-			_ = s.workerPool.Submit(func() {
-				s.handler(&Packet{
+			if action := s.dispatch(&Packet{
+				OpCode:  message.OpCode,
+				Request: message.Payload,
+				Conn:    conn,
+			}, func() {
+				s.onPongHandler(conn)
+			}); action != gnet.None {
+				return action
+			}
+		case ws.OpText, ws.OpBinary:
+			if cerr := s.checkMessage(message.OpCode, message.Payload); cerr != nil {
+				return s.closeConn(conn, s.closeCode(cerr), cerr)
+			}
+			if s.streamHandler != nil {
+				if action := s.dispatchStream(&Packet{
 					OpCode:  message.OpCode,
 					Request: message.Payload,
 					Conn:    conn,
-				})
-			})
-			conn.keepAlive()
+				}); action != gnet.None {
+					return action
+				}
+				continue
+			}
+			// async handle, the packet is released once the handler returned
+			packet := s.acquirePacket(conn, message)
+			if action, _ := s.submit(packet, packet.task); action != gnet.None {
+				return action
+			}
 		case ws.OpClose:
-			s.onCloseHandler(conn, nil)
-			return gnet.Close
+			return s.echoClose(conn, message.Payload)
 		default:
-			_ = s.CloseConn(conn, ws.StatusUnsupportedData, errors.New("unsupported opcode"))
-			return gnet.Close
+			return s.closeConn(conn, s.closeCode(ws.ErrProtocolOpCodeReserved), errors.New("unsupported opcode"))
 		}
 	}
+
+	if err != nil {
+		s.logger.Errorf("[-] read client message error: %s, remote: %s\n", err.Error(), c.RemoteAddr())
+		return s.closeConn(conn, s.closeCode(err), err)
+	}
+	if delayed && c.InboundBuffered() != 0 {
+		// decode the frames arrived during the delay
+		return s.OnTraffic(c)
+	}
 	return gnet.None
 }
 
 func NewServer(addr string, opts ...OptionFunc) *Server {
 	s := &Server{
 		addr: addr,
+		timeouts: timeouts{
+			idleRead: 15 * time.Second,
+		},
 	}
 	for _, opt := range opts {
 		opt(s)
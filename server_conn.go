@@ -2,10 +2,15 @@ package peregrine
 
 import (
 	"context"
+	"encoding/json"
 	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsflate"
 	"github.com/google/uuid"
 	"github.com/panjf2000/gnet/v2"
+	"github.com/pkg/errors"
+	"net"
 	"net/http"
+	"net/url"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -13,35 +18,294 @@ import (
 
 var (
 	emptyUpgrader = &ws.Upgrader{}
+
+	ErrConnClosed = errors.New("conn closed")
 )
 
 // Conn is upgraded websocket conn
 type Conn struct {
-	ctx           context.Context
+	ctx context.Context
+	// cancelCause cancel the context of conn once closed, nil if the conn is not created by the server
+	cancelCause   context.CancelCauseFunc
 	rwm           sync.RWMutex
 	readyUpgraded *atomic.Bool
 	LastActive    *atomic.Int64
 
+	// decoder only accessed by the event-loop
+	decoder decoder
+	// mailbox pending tasks in DispatchOrdered mode
+	mailbox mailbox
+	// compressor not nil if permessage-deflate negotiated
+	compressor *compressor
+	// coalescer not nil if the write coalescing enabled
+	coalescer *coalescer
+	// data the data messages held while a writer of NextWriter open
+	data dataQueue
+	// closing set after the close frame has been written
+	closing atomic.Bool
+	// reason the first reason of closing, guarded by rwm
+	reason error
+	// released set once the conn closed
+	released atomic.Bool
+
+	// remoteIP the ip counted by the limits, counted set if the conn is counted
+	remoteIP string
+	counted  bool
+
+	// stream not nil in streaming mode
+	stream *streamDispatcher
+
+	// limiter the rate limit of inbound messages
+	limiter rateLimiter
+	// delayed the messages delayed by the rate limit until delayUntil, delayedErr the decode error after them.
+	// only accessed by the event-loop
+	delayed    []message
+	delayedErr error
+	delayUntil time.Time
+
+	// timer the timeout check of conn
+	timer    timer
+	openedAt time.Time
+	// lastRead the unix nano of last inbound traffic
+	lastRead atomic.Int64
+	// written the bytes written by AsyncWrite, probed the written bytes known flushed
+	written atomic.Int64
+	probed  atomic.Int64
+	stall   stall
+
+	// pingSentAt the unix nano of the ping waiting for pong, lastPing the unix nano of last ping
+	pingSentAt atomic.Int64
+	lastPing   atomic.Int64
+	rtt        atomic.Int64
+
+	// handler the handler of route, or the handler of negotiated subprotocol, or the default handler
+	handler HandlerFunc
+
 	// Header all request headers obtained during handshake
 	Header http.Header
+	// Subprotocol the subprotocol negotiated during handshake, empty if none
+	Subprotocol string
+	// Path and Query the request uri of handshake
+	Path  string
+	Query url.Values
+	// params the path parameters of route
+	params map[string]string
 	ID     string
 	Keys   map[string]any
 
 	gnet.Conn
 }
 
-func (c *Conn) keepAlive() {
-	c.LastActive.Store(time.Now().Unix())
+// RTT returns the round-trip time measured by the last heartbeat, zero if not measured
+func (c *Conn) RTT() time.Duration {
+	return time.Duration(c.rtt.Load())
+}
+
+func (c *Conn) keepAlive(now time.Time) {
+	c.LastActive.Store(now.Unix())
+	c.lastRead.Store(now.UnixNano())
+}
+
+// AsyncWriteMessage write a message to the conn asynchronously, it's goroutine-safe.
+//
+// the complete frame is written by the event-loop with a single AsyncWrite,
+// so frames written from different goroutines never interleave.
+// the payload is compressed if permessage-deflate negotiated.
+// callback (could be nil) is called by the event-loop after the frame written
+func (c *Conn) AsyncWriteMessage(opCode ws.OpCode, p []byte, callback gnet.AsyncCallback) error {
+	if c.closing.Load() {
+		return net.ErrClosed
+	}
+
+	if c.compressor == nil || !opCode.IsData() {
+		var frame []byte
+		if callback != nil {
+			frame = compileFrame(ws.NewFrame(opCode, true, p))
+		} else {
+			// the pooled buffer is released once the frame written, it's left to the GC if the write failed
+			fb := getFrameBuffer()
+			fb.b = appendFrame(fb.b, ws.NewFrame(opCode, true, p))
+			frame, callback = fb.b, fb.release
+		}
+		if !opCode.IsData() {
+			// the control frames are never held by the open writer
+			return c.asyncWriteFrame(frame, callback)
+		}
+		return c.writeData(heldMessage{frame: frame, callback: callback})
+	}
+
+	// compressed messages must be written in the order of compression
+	c.compressor.mu.Lock()
+	defer c.compressor.mu.Unlock()
+
+	frame, err := c.compressor.frame(opCode, p)
+	if err != nil {
+		return err
+	}
+	return c.writeData(heldMessage{frame: compileFrame(frame), callback: callback})
+}
+
+// asyncWriteFrame write the encoded frame by the event-loop, the frame must not be modified after called
+func (c *Conn) asyncWriteFrame(frame []byte, callback gnet.AsyncCallback) error {
+	if c.closing.Load() {
+		return net.ErrClosed
+	}
+	if c.coalescer != nil {
+		return c.coalescer.write(callback, frame)
+	}
+	// the frame may be released by callback before AsyncWrite returned
+	n := int64(len(frame))
+	if err := c.Conn.AsyncWrite(frame, callback); err != nil {
+		return err
+	}
+	// counted after enqueued, so the probe of write stall never misses it
+	c.written.Add(n)
+	return nil
+}
+
+// WriteFrames write the frames to the conn asynchronously with a single writev, it's goroutine-safe.
+//
+// the frames are encoded as is (never compressed), so they could be control frames or fragments of a message.
+// frames written from different goroutines never interleave with them
+func (c *Conn) WriteFrames(frames ...ws.Frame) error {
+	if c.closing.Load() {
+		return net.ErrClosed
+	}
+
+	var (
+		bufs = make([][]byte, len(frames))
+		data bool
+	)
+	for i, frame := range frames {
+		bufs[i] = compileFrame(frame)
+		data = data || frame.Header.OpCode.IsData()
+	}
+	if data {
+		return c.writeData(heldMessage{frames: bufs})
+	}
+	return c.asyncWriteFrames(bufs, nil)
+}
+
+// asyncWriteFrames write the encoded frames by the event-loop with a single writev
+func (c *Conn) asyncWriteFrames(bufs [][]byte, callback gnet.AsyncCallback) error {
+	if c.closing.Load() {
+		return net.ErrClosed
+	}
+	if c.coalescer != nil {
+		return c.coalescer.write(callback, bufs...)
+	}
+	var n int64
+	for _, b := range bufs {
+		n += int64(len(b))
+	}
+	if err := c.Conn.AsyncWritev(bufs, callback); err != nil {
+		return err
+	}
+	c.written.Add(n)
+	return nil
+}
+
+// WriteMessage write a message to the conn asynchronously, see AsyncWriteMessage
+func (c *Conn) WriteMessage(opCode ws.OpCode, p []byte) error {
+	return c.AsyncWriteMessage(opCode, p, nil)
+}
+
+func (c *Conn) WriteText(p []byte) error {
+	return c.AsyncWriteMessage(ws.OpText, p, nil)
+}
+
+func (c *Conn) WriteBinary(p []byte) error {
+	return c.AsyncWriteMessage(ws.OpBinary, p, nil)
 }
 
+// WriteJSON write the json encoding of v as a text message
+func (c *Conn) WriteJSON(v any) error {
+	p, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.AsyncWriteMessage(ws.OpText, p, nil)
+}
+
+func (c *Conn) WritePing(p []byte) error {
+	return c.AsyncWriteMessage(ws.OpPing, p, nil)
+}
+
+func (c *Conn) WritePong(p []byte) error {
+	return c.AsyncWriteMessage(ws.OpPong, p, nil)
+}
+
+// WriteClose write a close frame and close the conn after the frame written,
+// any write after WriteClose returns net.ErrClosed
+func (c *Conn) WriteClose(statusCode ws.StatusCode, reason string) error {
+	if !c.closing.CompareAndSwap(false, true) {
+		return net.ErrClosed
+	}
+	return c.Conn.AsyncWrite(
+		compileFrame(ws.NewCloseFrame(ws.NewCloseFrameBody(statusCode, reason))),
+		func(conn gnet.Conn, _ error) error { return conn.Close() },
+	)
+}
+
+// writeCloseFrame write a close frame, the conn is closed once the close frame of peer arrived
+func (c *Conn) writeCloseFrame(statusCode ws.StatusCode, reason string) error {
+	if !c.closing.CompareAndSwap(false, true) {
+		return net.ErrClosed
+	}
+	return c.Conn.AsyncWrite(compileFrame(ws.NewCloseFrame(ws.NewCloseFrameBody(statusCode, reason))), nil)
+}
+
+func (c *Conn) setCloseReason(reason error) {
+	c.rwm.Lock()
+	if c.reason == nil {
+		c.reason = reason
+	}
+	c.rwm.Unlock()
+}
+
+// closeReason returns the reason set by server, or err if not set
+func (c *Conn) closeReason(err error) error {
+	c.rwm.RLock()
+	defer c.rwm.RUnlock()
+	if c.reason != nil {
+		return c.reason
+	}
+	return err
+}
+
+// useCompression enable permessage-deflate on the conn with the negotiated parameters
+func (c *Conn) useCompression(options CompressionOptions, params wsflate.Parameters) {
+	c.compressor = newCompressor(
+		options.level(),
+		options.MinSize,
+		params.ServerNoContextTakeover,
+		params.ServerMaxWindowBits,
+	)
+	c.decoder.decompressor = newDecompressor(params.ClientNoContextTakeover)
+}
+
+// Context returns the context of conn, it's derived from the server context (WithContext)
+// and canceled once the conn closed, context.Cause returns the reason of closing (ErrConnClosed by default)
 func (c *Conn) Context() context.Context {
 	return c.ctx
 }
 
+// SetContext replace the context of conn, ctx should be derived from Context to be canceled once the conn closed
 func (c *Conn) SetContext(ctx context.Context) {
 	c.ctx = ctx
 }
 
+// cancel the context of conn with the reason of closing
+func (c *Conn) cancel(reason error) {
+	if c.cancelCause == nil {
+		return
+	}
+	if reason == nil {
+		reason = ErrConnClosed
+	}
+	c.cancelCause(reason)
+}
+
 func (c *Conn) Set(key string, value any) {
 	c.rwm.Lock()
 	if c.Keys == nil {
@@ -58,6 +322,11 @@ func (c *Conn) Get(key string) (any, bool) {
 	return value, found
 }
 
+// Param returns the path parameter of route, e.g. Param("id") of "/ws/feed/:id"
+func (c *Conn) Param(name string) string {
+	return c.params[name]
+}
+
 func NewUpgraderConn(conn gnet.Conn) *Conn {
 	lastActive := &atomic.Int64{}
 	lastActive.Store(time.Now().Unix())
@@ -70,6 +339,31 @@ func NewUpgraderConn(conn gnet.Conn) *Conn {
 	}
 }
 
+// PreparedMessage is a message encoded once and written to many conns, it's never compressed
+type PreparedMessage struct {
+	frame []byte
+}
+
+func NewPreparedMessage(opCode ws.OpCode, p []byte) *PreparedMessage {
+	return &PreparedMessage{frame: compileFrame(ws.NewFrame(opCode, true, p))}
+}
+
+// WritePreparedMessage write the prepared message to the conn asynchronously, it's goroutine-safe
+func (c *Conn) WritePreparedMessage(pm *PreparedMessage) error {
+	if c.closing.Load() {
+		return net.ErrClosed
+	}
+	if ws.OpCode(pm.frame[0] & 0x0f).IsData() {
+		return c.writeData(heldMessage{frame: pm.frame})
+	}
+	return c.asyncWriteFrame(pm.frame, nil)
+}
+
+// compileFrame encode the frame into a new slice
+func compileFrame(frame ws.Frame) []byte {
+	return appendFrame(make([]byte, 0, ws.HeaderSize(frame.Header)+len(frame.Payload)), frame)
+}
+
 func TryAssertKeys[T any](c *Conn, key string) (T, bool) {
 	val, found := c.Get(key)
 	if !found {
@@ -1,6 +1,8 @@
 package peregrine_test
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"github.com/RealFax/peregrine"
 	"github.com/gobwas/ws"
@@ -14,7 +16,76 @@ import (
 
 func Handler(req *peregrine.Packet) {
 	// echo
-	wsutil.WriteServerText(req.Conn, req.Request)
+	req.Conn.WriteText(req.Request)
+}
+
+func TestServer_SlowConsumer(t *testing.T) {
+	reported := make(chan int, 1)
+	server := peregrine.NewServer(
+		"tcp://127.0.0.1:19611",
+		peregrine.WithMaxOutboundBuffer(64<<10, peregrine.SlowConsumerClose),
+		peregrine.WithOnSlowConsumerHandler(func(_ *peregrine.Conn, buffered int) {
+			select {
+			case reported <- buffered:
+			default:
+			}
+		}),
+		peregrine.WithHandler(func(packet *peregrine.Packet) {
+			// flood the client which never reads
+			p := bytes.Repeat([]byte("peregrine"), 1024)
+			for i := 0; i < 8192; i++ {
+				if packet.Conn.WriteText(p) != nil {
+					return
+				}
+			}
+		}),
+	)
+
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- server.ListenAndServe(gnet.WithReuseAddr(true))
+	}()
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_ = server.Shutdown(ctx)
+		<-stopped
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	conn, _, _, err := ws.Dial(context.Background(), "ws://127.0.0.1:19611")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err = wsutil.WriteClientText(conn, []byte("flood")); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case buffered := <-reported:
+		if buffered <= 64<<10 {
+			t.Fatalf("reported under the limit: %d", buffered)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("slow consumer not reported")
+	}
+
+	// the frames buffered before the limit exceeded, then the close frame
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		frame, err := ws.ReadFrame(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if frame.Header.OpCode != ws.OpClose {
+			continue
+		}
+		if code, _ := ws.ParseCloseFrameData(frame.Payload); code != peregrine.StatusTryAgainLater {
+			t.Fatalf("unexpected close code: %d", code)
+		}
+		return
+	}
 }
 
 func TestServer_ListenAndServer(t *testing.T) {
@@ -0,0 +1,86 @@
+package peregrine
+
+import (
+	"context"
+	"github.com/gobwas/ws"
+	"github.com/panjf2000/gnet/v2"
+	"github.com/pkg/errors"
+	"net/http"
+	"time"
+)
+
+const (
+	shutdownPollInterval = 10 * time.Millisecond
+)
+
+var (
+	ErrServerClosed = errors.New("server closed")
+)
+
+// Shutdown gracefully shuts down the server.
+//
+// Shutdown rejects the new connections, writes a close frame (see WithShutdownClose) to every upgraded Conn,
+// then waits for the close frames of peers and the in-flight handlers until ctx done, finally stops the engine.
+// the messages arrived after the close frame written are discarded
+func (s *Server) Shutdown(ctx context.Context) error {
+	if !s.shutdown.CompareAndSwap(false, true) {
+		return ErrServerClosed
+	}
+
+	s.Range(func(conn *Conn) bool {
+		conn.setCloseReason(ErrServerClosed)
+		_ = conn.writeCloseFrame(s.shutdownCloseCode, s.shutdownReason)
+		return true
+	})
+
+	err := s.wait(ctx)
+	if stopErr := s.engine.Stop(ctx); err == nil {
+		err = stopErr
+	}
+	return err
+}
+
+// checkShutdown returns the rejection of handshake if the server is shutting down,
+// the conns opened before Shutdown may finish the handshake after it
+func (s *Server) checkShutdown() error {
+	if !s.shutdown.Load() {
+		return nil
+	}
+	return ws.RejectConnectionError(
+		ws.RejectionStatus(http.StatusServiceUnavailable),
+		ws.RejectionReason(ErrServerClosed.Error()),
+	)
+}
+
+// wait until the upgraded conns closed and the in-flight tasks done, or ctx done
+func (s *Server) wait(ctx context.Context) error {
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+
+	for s.registry.len() != 0 || s.inflight.Load() != 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// awaitClose handle the traffic after the close frame written, only the close frame of peer is accepted
+func (s *Server) awaitClose(c gnet.Conn, conn *Conn) gnet.Action {
+	if !conn.readyUpgraded.Load() {
+		return gnet.Close
+	}
+
+	messages, err := conn.decoder.Decode(c)
+	if err != nil {
+		return gnet.Close
+	}
+	for _, message := range messages {
+		if message.OpCode == ws.OpClose {
+			return gnet.Close
+		}
+	}
+	return gnet.None
+}
@@ -0,0 +1,118 @@
+package peregrine
+
+import (
+	"github.com/gobwas/ws"
+	"github.com/panjf2000/gnet/v2"
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrSlowConsumer = errors.New("slow consumer")
+)
+
+// SlowConsumerPolicy decides what to do with the outbound frames of a conn over the max outbound buffer
+type SlowConsumerPolicy uint8
+
+const (
+	// SlowConsumerDropNewest drop the frames written after the limit exceeded
+	SlowConsumerDropNewest SlowConsumerPolicy = iota
+
+	// SlowConsumerDropOldest drop the oldest frames not written to the outbound buffer until the limit satisfied
+	SlowConsumerDropOldest
+
+	// SlowConsumerClose close the conn with the slow consumer close code
+	SlowConsumerClose
+)
+
+// droppable reports whether the encoded frame could be dropped without breaking the stream of conn.
+//
+// only the uncompressed and unfragmented data messages are dropped,
+// the control frames, fragments and compressed messages (which may depend on the previous ones) are always written
+func droppable(frame []byte) bool {
+	opCode := ws.OpCode(frame[0] & 0x0f)
+	return frame[0]&0x80 != 0 && frame[0]&0x70 == 0 && (opCode == ws.OpText || opCode == ws.OpBinary)
+}
+
+// DroppedFrames returns the count of outbound frames dropped by the slow consumer policy
+func (s *Server) DroppedFrames() uint64 {
+	return s.droppedFrames.Load()
+}
+
+// slowConsumer report the conn which outbound buffer exceeded the limit, buffered the pending outbound bytes
+func (s *Server) slowConsumer(conn *Conn, buffered int) {
+	s.onSlowConsumerHandler(conn, buffered)
+}
+
+// shed apply the slow consumer policy to the pending frames before the new frames of n bytes queued,
+// it's called with the lock held. returns the frames evicted, and whether the new frames are accepted
+func (w *coalescer) shed(n int, newDroppable bool) (evicted []pendingFrame, ok bool) {
+	switch w.s.slowConsumerPolicy {
+	case SlowConsumerDropOldest:
+		kept := w.pending[:0]
+		for _, frame := range w.pending {
+			if w.size+n > w.s.maxOutbound && droppable(frame.b) {
+				evicted = append(evicted, frame)
+				w.size -= len(frame.b)
+				continue
+			}
+			kept = append(kept, frame)
+		}
+		clear(w.pending[len(kept):])
+		w.pending = kept
+		return evicted, true
+	case SlowConsumerClose:
+		return nil, false
+	default:
+		return nil, !newDroppable
+	}
+}
+
+// evict apply the slow consumer policy to the frames being flushed, it's called by the event-loop.
+//
+// the dropped frames are marked by nil, returns ErrSlowConsumer if the conn is closed
+func (w *coalescer) evict(c gnet.Conn, budget int) error {
+	var (
+		total   int
+		dropped uint64
+	)
+	for _, frame := range w.flushing {
+		total += len(frame.b)
+	}
+	drop := func(i int) {
+		total -= len(w.flushing[i].b)
+		if callback := w.flushing[i].callback; callback != nil {
+			_ = callback(c, ErrSlowConsumer)
+		}
+		w.flushing[i] = pendingFrame{}
+		dropped++
+	}
+
+	switch w.s.slowConsumerPolicy {
+	case SlowConsumerDropOldest:
+		for i := 0; i < len(w.flushing) && total > budget; i++ {
+			if droppable(w.flushing[i].b) {
+				drop(i)
+			}
+		}
+	case SlowConsumerClose:
+		w.s.closeConn(w.conn, w.s.slowConsumerCloseCode, ErrSlowConsumer)
+		_ = c.Close()
+		return ErrSlowConsumer
+	default:
+		// the frames are written in order, the frames after the first dropped one are dropped
+		size := 0
+		for i := range w.flushing {
+			if !droppable(w.flushing[i].b) {
+				size += len(w.flushing[i].b)
+				continue
+			}
+			if dropped != 0 || size+len(w.flushing[i].b) > budget {
+				drop(i)
+				continue
+			}
+			size += len(w.flushing[i].b)
+		}
+	}
+	w.s.droppedFrames.Add(dropped)
+	return nil
+}
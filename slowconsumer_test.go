@@ -0,0 +1,124 @@
+package peregrine
+
+import (
+	"bytes"
+	"github.com/gobwas/ws"
+	"github.com/panjf2000/gnet/v2"
+	"github.com/pkg/errors"
+	"net"
+	"testing"
+)
+
+// newSlowConsumer returns a conn of server with the max outbound buffer of 300 bytes,
+// the outbound buffer of conn is buffered bytes
+func newSlowConsumer(t *testing.T, policy SlowConsumerPolicy, buffered int) (*Server, *loopConn, *Conn, *[]int) {
+	var reported []int
+	s := NewServer(
+		"tcp://127.0.0.1:0",
+		WithMaxOutboundBuffer(300, policy),
+		WithOnSlowConsumerHandler(func(_ *Conn, buffered int) {
+			reported = append(reported, buffered)
+		}),
+	)
+	c := &loopConn{loop: newTestLoop()}
+	c.buffered = buffered
+	conn := NewUpgraderConn(c)
+	conn.coalescer = newCoalescer(conn, s)
+	return s, c, conn, &reported
+}
+
+// frameOf returns the payload of 100 bytes frame
+func frameOf(b byte) []byte {
+	return bytes.Repeat([]byte{b}, 98)
+}
+
+// writtenPayloads returns the first byte of the payload of each frame written to c
+func writtenPayloads(t *testing.T, c *loopConn) string {
+	var written []byte
+	for _, frame := range readFrames(t, &c.mockConn) {
+		if frame.Header.OpCode == ws.OpPing {
+			written = append(written, 'p')
+			continue
+		}
+		written = append(written, frame.Payload[0])
+	}
+	return string(written)
+}
+
+func TestServer_SlowConsumerDropNewest(t *testing.T) {
+	s, c, conn, reported := newSlowConsumer(t, SlowConsumerDropNewest, 100)
+
+	for _, b := range []byte("123") {
+		if err := conn.WriteText(frameOf(b)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the pending frames alone exceeded the limit
+	if err := conn.WriteText(frameOf('4')); !errors.Is(err, ErrSlowConsumer) {
+		t.Fatalf("expect ErrSlowConsumer, got: %v", err)
+	}
+	// the control frames are never dropped
+	if err := conn.WritePing(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// 100 bytes buffered, only 2 frames could be written
+	c.loop.run()
+	if written := writtenPayloads(t, c); written != "12p" {
+		t.Fatalf("unexpected frames written: %s", written)
+	}
+	if s.DroppedFrames() != 2 || len(*reported) != 2 {
+		t.Fatalf("expect 2 frames dropped and reported twice, got: %d, %v", s.DroppedFrames(), *reported)
+	}
+}
+
+func TestServer_SlowConsumerDropOldest(t *testing.T) {
+	s, c, conn, reported := newSlowConsumer(t, SlowConsumerDropOldest, 100)
+
+	var evicted error
+	if err := conn.AsyncWriteMessage(ws.OpText, frameOf('1'), func(_ gnet.Conn, err error) error {
+		evicted = err
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range []byte("234") {
+		if err := conn.WriteText(frameOf(b)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !errors.Is(evicted, ErrSlowConsumer) {
+		t.Fatalf("oldest frame not evicted, callback error: %v", evicted)
+	}
+
+	c.loop.run()
+	if written := writtenPayloads(t, c); written != "34" {
+		t.Fatalf("unexpected frames written: %s", written)
+	}
+	if s.DroppedFrames() != 2 || len(*reported) != 2 {
+		t.Fatalf("expect 2 frames dropped and reported twice, got: %d, %v", s.DroppedFrames(), *reported)
+	}
+}
+
+func TestServer_SlowConsumerClose(t *testing.T) {
+	_, c, conn, reported := newSlowConsumer(t, SlowConsumerClose, 1000)
+
+	if err := conn.WriteText(frameOf('1')); err != nil {
+		t.Fatal(err)
+	}
+	c.loop.run()
+
+	frames := readFrames(t, &c.mockConn)
+	if len(frames) != 1 || frames[0].Header.OpCode != ws.OpClose {
+		t.Fatalf("expect only the close frame written, got: %v", frames)
+	}
+	if code, _ := ws.ParseCloseFrameData(frames[0].Payload); code != StatusTryAgainLater {
+		t.Fatalf("unexpected close code: %d", code)
+	}
+	if !c.closed || len(*reported) != 1 || (*reported)[0] != 1100 {
+		t.Fatalf("conn not closed or not reported: %v", *reported)
+	}
+	if err := conn.WriteText(frameOf('2')); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expect net.ErrClosed, got: %v", err)
+	}
+}
@@ -0,0 +1,425 @@
+package peregrine
+
+import (
+	"bytes"
+	"github.com/gobwas/ws"
+	"github.com/panjf2000/gnet/v2"
+	"io"
+	"net"
+	"sync"
+)
+
+const (
+	defaultStreamWindow = 256 * 1024
+	defaultFragmentSize = 32 * 1024
+)
+
+// StreamHandlerFunc handle a data message as a stream, r returns io.EOF at the end of message,
+// or io.ErrUnexpectedEOF if the conn closed before it. the rest of message is discarded once the handler returned
+type StreamHandlerFunc func(conn *Conn, opCode ws.OpCode, r io.Reader)
+
+// stream is the reader of a streaming message, written by the event-loop and read by the handler.
+//
+// once the buffered payload reached the window, the event-loop stops decoding the frames of conn,
+// they stay in the inbound buffer until the handler read the half of window
+type stream struct {
+	conn   *Conn
+	window int
+
+	mu       sync.Mutex
+	cond     sync.Cond
+	chunks   [][]byte
+	buffered int
+	// err io.EOF once the message ended
+	err error
+	// closed set once the handler returned, the rest of message is discarded
+	closed bool
+	// paused set if the event-loop stopped decoding
+	paused bool
+}
+
+func newStream(conn *Conn, window int) *stream {
+	st := &stream{conn: conn, window: window}
+	st.cond.L = &st.mu
+	return st
+}
+
+// room returns the payload bytes can be buffered, the stream is paused if it's full
+func (st *stream) room() int {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.closed {
+		// discarded
+		return st.window
+	}
+	room := st.window - st.buffered
+	if room <= 0 {
+		st.paused = true
+	}
+	return room
+}
+
+// write is called by the event-loop
+func (st *stream) write(p []byte) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.closed {
+		return
+	}
+	st.chunks = append(st.chunks, p)
+	st.buffered += len(p)
+	st.cond.Signal()
+}
+
+// finish the message with err
+func (st *stream) finish(err error) {
+	st.mu.Lock()
+	if st.err == nil {
+		st.err = err
+	}
+	st.cond.Signal()
+	st.mu.Unlock()
+}
+
+func (st *stream) Read(p []byte) (int, error) {
+	st.mu.Lock()
+	for len(st.chunks) == 0 && st.err == nil {
+		st.cond.Wait()
+	}
+	if len(st.chunks) == 0 {
+		err := st.err
+		st.mu.Unlock()
+		return 0, err
+	}
+
+	n := copy(p, st.chunks[0])
+	if st.chunks[0] = st.chunks[0][n:]; len(st.chunks[0]) == 0 {
+		st.chunks[0] = nil
+		st.chunks = st.chunks[1:]
+	}
+	st.buffered -= n
+
+	resume := st.paused && st.buffered <= st.window/2
+	if resume {
+		st.paused = false
+	}
+	st.mu.Unlock()
+
+	if resume {
+		// trigger OnTraffic to decode the rest of frames
+		_ = st.conn.Conn.Wake(nil)
+	}
+	return n, nil
+}
+
+// close discard the rest of message, it's called once the handler returned
+func (st *stream) close() {
+	st.mu.Lock()
+	st.closed = true
+	st.chunks, st.buffered = nil, 0
+	resume := st.paused
+	st.paused = false
+	st.mu.Unlock()
+
+	if resume {
+		_ = st.conn.Conn.Wake(nil)
+	}
+}
+
+// streamDispatcher is the streamSink of conn, the message is dispatched to the StreamHandlerFunc once it began
+type streamDispatcher struct {
+	s    *Server
+	conn *Conn
+	// current the stream of the message being received, only accessed by the event-loop
+	current *stream
+}
+
+func (d *streamDispatcher) begin(opCode ws.OpCode) error {
+	st := newStream(d.conn, d.s.streamWindow)
+	d.current = st
+
+	action, dropped := d.s.submit(&Packet{OpCode: opCode, Conn: d.conn}, func() {
+		defer d.s.inflight.Add(-1)
+		defer st.close()
+		d.s.streamHandler(d.conn, opCode, st)
+	})
+	if dropped {
+		// no one reads the stream
+		st.close()
+	}
+	if action != gnet.None {
+		return ErrOverload
+	}
+	return nil
+}
+
+func (d *streamDispatcher) room() int {
+	return d.current.room()
+}
+
+func (d *streamDispatcher) write(p []byte) {
+	d.current.write(p)
+}
+
+func (d *streamDispatcher) end() {
+	d.current.finish(io.EOF)
+	d.current = nil
+}
+
+// abort the message being received, it's called once the conn closed
+func (d *streamDispatcher) abort() {
+	if d.current != nil {
+		d.current.finish(io.ErrUnexpectedEOF)
+		d.current = nil
+	}
+}
+
+// dispatchStream dispatch the buffered message (e.g. compressed) to the StreamHandlerFunc
+func (s *Server) dispatchStream(packet *Packet) gnet.Action {
+	return s.dispatch(packet, func() {
+		s.streamHandler(packet.Conn, packet.OpCode, bytes.NewReader(packet.Request))
+	})
+}
+
+// heldMessage is a data message of encoded frame (or frames), or a message of the writer of NextWriter
+type heldMessage struct {
+	frame    []byte
+	frames   [][]byte
+	callback gnet.AsyncCallback
+	writer   *messageWriter
+}
+
+// dataQueue keeps the data messages of conn in order, so they never interleave with the fragments of a writer.
+//
+// the messages written while a writer open are held until it closed, then written by the goroutine
+// which found the queue idle. the lock is never held while writing, the writers are never blocked
+type dataQueue struct {
+	mu   sync.Mutex
+	held []heldMessage
+	// writing set while a goroutine writes the messages
+	writing bool
+	// writer the open writer of the message being written, nil if none
+	writer *messageWriter
+}
+
+// writeData write the data message, or hold it until the open writer closed
+func (c *Conn) writeData(m heldMessage) error {
+	q := &c.data
+	q.mu.Lock()
+	if q.writing || q.writer != nil || len(q.held) != 0 {
+		if c.released.Load() {
+			q.mu.Unlock()
+			return net.ErrClosed
+		}
+		q.held = append(q.held, m)
+		q.mu.Unlock()
+		return nil
+	}
+	q.writing = true
+	q.mu.Unlock()
+
+	var err error
+	if m.frames != nil {
+		err = c.asyncWriteFrames(m.frames, m.callback)
+	} else {
+		err = c.asyncWriteFrame(m.frame, m.callback)
+	}
+	c.drain()
+	return err
+}
+
+// drain write the held messages until the queue is empty, or the open writer waits for more fragments
+func (c *Conn) drain() {
+	q := &c.data
+	for {
+		q.mu.Lock()
+		if w := q.writer; w != nil {
+			if len(w.pending) != 0 {
+				frames := w.pending
+				w.pending = nil
+				q.mu.Unlock()
+				c.writeFragments(w, frames)
+				continue
+			}
+			if !w.fin {
+				q.writing = false
+				q.mu.Unlock()
+				return
+			}
+			q.writer = nil
+		}
+		if len(q.held) == 0 {
+			q.writing = false
+			q.mu.Unlock()
+			return
+		}
+		m := q.held[0]
+		q.held[0] = heldMessage{}
+		q.held = q.held[1:]
+		if m.writer != nil {
+			// the message of writer begins, the messages after it are held until it closed
+			q.writer = m.writer
+			q.mu.Unlock()
+			continue
+		}
+		q.mu.Unlock()
+
+		var err error
+		if m.frames != nil {
+			err = c.asyncWriteFrames(m.frames, m.callback)
+		} else {
+			err = c.asyncWriteFrame(m.frame, m.callback)
+		}
+		if err != nil && m.callback != nil {
+			_ = m.callback(c.Conn, err)
+		}
+	}
+}
+
+// writeFragments write the fragments of writer, the first error is returned by the next Write or Close
+func (c *Conn) writeFragments(w *messageWriter, frames [][]byte) {
+	for _, frame := range frames {
+		if err := c.asyncWriteFrame(frame, nil); err != nil {
+			c.data.mu.Lock()
+			if w.err == nil {
+				w.err = err
+			}
+			c.data.mu.Unlock()
+			return
+		}
+	}
+}
+
+// discardHeld drop the held messages once the conn closed, their callbacks are called with net.ErrClosed
+func (c *Conn) discardHeld() {
+	q := &c.data
+	q.mu.Lock()
+	held := q.held
+	q.held = nil
+	if q.writer != nil {
+		q.writer.err, q.writer.pending = net.ErrClosed, nil
+		q.writer = nil
+	}
+	for _, m := range held {
+		if m.writer != nil {
+			m.writer.err, m.writer.pending = net.ErrClosed, nil
+		}
+	}
+	q.mu.Unlock()
+
+	for _, m := range held {
+		if m.callback != nil {
+			_ = m.callback(c.Conn, net.ErrClosed)
+		}
+	}
+}
+
+// messageWriter writes a message as fragmented frames
+type messageWriter struct {
+	conn    *Conn
+	opCode  ws.OpCode
+	buf     []byte
+	started bool
+	closed  bool
+
+	// pending the fragments not written, fin set once the final one queued,
+	// err the error of writing the fragments. guarded by the lock of dataQueue
+	pending [][]byte
+	fin     bool
+	err     error
+}
+
+// NextWriter returns a writer of a message of opCode, the message is written as fragmented frames
+// of the buffered payload (32KB), the final frame is written by Close.
+//
+// the frames are not compressed. the other data messages (and writers) of the conn are held until the writer closed,
+// so they never interleave with the fragments, the control frames are written without waiting.
+// the writer must be closed, the held messages are discarded if the conn closed before it
+func (c *Conn) NextWriter(opCode ws.OpCode) (io.WriteCloser, error) {
+	if c.closing.Load() {
+		return nil, net.ErrClosed
+	}
+
+	w := &messageWriter{
+		conn:   c,
+		opCode: opCode,
+		buf:    make([]byte, 0, defaultFragmentSize),
+	}
+	q := &c.data
+	q.mu.Lock()
+	if q.writing || q.writer != nil || len(q.held) != 0 {
+		// the fragments are held until the messages before it written
+		q.held = append(q.held, heldMessage{writer: w})
+	} else {
+		q.writer = w
+	}
+	q.mu.Unlock()
+	return w, nil
+}
+
+func (w *messageWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, net.ErrClosed
+	}
+
+	written := 0
+	for len(p) > 0 {
+		n := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		written += n
+
+		if len(w.buf) == cap(w.buf) {
+			if err := w.flush(false); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// Close write the final frame, and the data messages held by the writer
+func (w *messageWriter) Close() error {
+	if w.closed {
+		return net.ErrClosed
+	}
+	w.closed = true
+	return w.flush(true)
+}
+
+// flush queue the buffered payload as a fragment, it's written at once if the writer is writing the conn
+func (w *messageWriter) flush(fin bool) error {
+	opCode := ws.OpContinuation
+	if !w.started {
+		opCode = w.opCode
+		w.started = true
+	}
+	// the payload is copied into the frame
+	frame := compileFrame(ws.NewFrame(opCode, fin, w.buf))
+	w.buf = w.buf[:0]
+
+	q := &w.conn.data
+	q.mu.Lock()
+	if w.err != nil {
+		err := w.err
+		q.mu.Unlock()
+		return err
+	}
+	w.pending = append(w.pending, frame)
+	w.fin = fin
+	if q.writing || q.writer != w {
+		// written by the goroutine writing the conn
+		q.mu.Unlock()
+		return nil
+	}
+	q.writing = true
+	q.mu.Unlock()
+
+	w.conn.drain()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return w.err
+}
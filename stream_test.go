@@ -0,0 +1,211 @@
+package peregrine
+
+import (
+	"bytes"
+	"github.com/gobwas/ws"
+	"github.com/panjf2000/gnet/v2"
+	"github.com/pkg/errors"
+	"io"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+type streamResult struct {
+	opCode  ws.OpCode
+	payload []byte
+	err     error
+}
+
+func TestServer_StreamHandler(t *testing.T) {
+	const window = 1024
+
+	var (
+		release = make(chan struct{})
+		results = make(chan streamResult, 2)
+	)
+	s := NewServer(
+		"tcp://127.0.0.1:0",
+		WithDispatchMode(DispatchOrdered),
+		WithStreamWindow(window),
+		WithStreamHandler(func(_ *Conn, opCode ws.OpCode, r io.Reader) {
+			<-release
+			payload, err := io.ReadAll(r)
+			results <- streamResult{opCode: opCode, payload: payload, err: err}
+		}),
+	)
+	c, _ := upgradeMockConn(t, s)
+	c.woken = make(chan struct{}, 16)
+
+	var (
+		payload = bytes.Repeat([]byte("peregrine"), 1024)
+		half    = len(payload) / 2
+	)
+	// a fragmented message with a ping in the middle, the payload arrives in parts
+	c.inbound.Write(compileClientFrame(t, ws.NewFrame(ws.OpBinary, false, payload[:half])))
+	c.inbound.Write(compileClientFrame(t, ws.NewPingFrame([]byte("ping"))))
+	final := compileClientFrame(t, ws.NewFrame(ws.OpContinuation, true, payload[half:]))
+	c.inbound.Write(final[:100])
+	if action := s.OnTraffic(c); action != gnet.None {
+		t.Fatalf("unexpected action: %v", action)
+	}
+
+	// the decoding stopped once the window full, the rest frames stay in the inbound buffer
+	if c.inbound.Len() < len(payload[:half])-window {
+		t.Fatalf("frames decoded over the window, buffered: %d", c.inbound.Len())
+	}
+	c.inbound.Write(final[100:])
+	buffered := c.inbound.Len()
+	if action := s.OnTraffic(c); action != gnet.None || c.inbound.Len() != buffered {
+		t.Fatalf("frames decoded while the stream is full, action: %v, buffered: %d", action, c.inbound.Len())
+	}
+
+	// the handler reads the stream, the conn is woken up to decode the rest of frames
+	close(release)
+	var result streamResult
+	for done := false; !done; {
+		select {
+		case <-c.woken:
+			if action := s.OnTraffic(c); action != gnet.None {
+				t.Fatalf("unexpected action: %v", action)
+			}
+		case result = <-results:
+			done = true
+		case <-time.After(time.Second):
+			t.Fatal("stream not handled")
+		}
+	}
+
+	if result.err != nil || result.opCode != ws.OpBinary || !bytes.Equal(result.payload, payload) {
+		t.Fatalf("unexpected stream: %v, %v, length: %d", result.opCode, result.err, len(result.payload))
+	}
+	if c.inbound.Len() != 0 {
+		t.Fatalf("frames not decoded, buffered: %d", c.inbound.Len())
+	}
+	if frame, err := ws.ReadFrame(&c.outbound); err != nil || frame.Header.OpCode != ws.OpPong {
+		t.Fatalf("ping in the middle of stream not answered: %v, %v", frame, err)
+	}
+
+	// the conn closed in the middle of message
+	c.inbound.Write(compileClientFrame(t, ws.NewFrame(ws.OpText, false, []byte("peregrine"))))
+	if action := s.OnTraffic(c); action != gnet.None {
+		t.Fatalf("unexpected action: %v", action)
+	}
+	_ = s.OnClose(c, nil)
+	select {
+	case result = <-results:
+		if result.err != io.ErrUnexpectedEOF || string(result.payload) != "peregrine" {
+			t.Fatalf("unexpected stream: %v, %s", result.err, result.payload)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("stream not aborted")
+	}
+}
+
+func TestConn_NextWriter(t *testing.T) {
+	var (
+		c       = &mockConn{}
+		conn    = NewUpgraderConn(c)
+		payload = bytes.Repeat([]byte("peregrine"), defaultFragmentSize/4)
+	)
+
+	w, err := conn.NextWriter(ws.OpBinary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// written in small parts
+	for p := payload; len(p) > 0; p = p[min(len(p), 1000):] {
+		if _, err = w.Write(p[:min(len(p), 1000)]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = w.Write(payload); err == nil {
+		t.Fatal("write after close")
+	}
+
+	var (
+		frames   int
+		received []byte
+	)
+	for c.outbound.Len() > 0 {
+		frame, rerr := ws.ReadFrame(&c.outbound)
+		if rerr != nil {
+			t.Fatal(rerr)
+		}
+		expect := ws.OpContinuation
+		if frames == 0 {
+			expect = ws.OpBinary
+		}
+		if frame.Header.OpCode != expect || len(frame.Payload) > defaultFragmentSize || frame.Header.Fin != (c.outbound.Len() == 0) {
+			t.Fatalf("unexpected frame %d: %+v", frames, frame.Header)
+		}
+		received = append(received, frame.Payload...)
+		frames++
+	}
+	if frames != 3 || !bytes.Equal(received, payload) {
+		t.Fatalf("unexpected message, frames: %d, length: %d", frames, len(received))
+	}
+}
+
+func TestConn_NextWriterHeld(t *testing.T) {
+	var (
+		c    = &mockConn{}
+		conn = NewUpgraderConn(c)
+	)
+
+	w, err := conn.NextWriter(ws.OpBinary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first fragment
+	if _, err = w.Write(bytes.Repeat([]byte{'p'}, defaultFragmentSize)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the data messages and writers are held without blocking, the control frames are written at once
+	if err = conn.WriteText([]byte("peregrine")); err != nil {
+		t.Fatal(err)
+	}
+	next, err := conn.NextWriter(ws.OpText)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = next.Write([]byte("next"))
+	if err = next.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = conn.WritePing(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var opCodes []ws.OpCode
+	for _, frame := range readFrames(t, c) {
+		opCodes = append(opCodes, frame.Header.OpCode)
+	}
+	expect := []ws.OpCode{ws.OpBinary, ws.OpPing, ws.OpContinuation, ws.OpText, ws.OpText}
+	if !slices.Equal(opCodes, expect) {
+		t.Fatalf("unexpected frames: %v", opCodes)
+	}
+
+	// the held messages are discarded once the conn closed
+	if w, err = conn.NextWriter(ws.OpBinary); err != nil {
+		t.Fatal(err)
+	}
+	var discarded error
+	_ = conn.AsyncWriteMessage(ws.OpText, []byte("peregrine"), func(_ gnet.Conn, err error) error {
+		discarded = err
+		return nil
+	})
+	conn.discardHeld()
+	if !errors.Is(discarded, net.ErrClosed) || !errors.Is(w.Close(), net.ErrClosed) {
+		t.Fatalf("held message not discarded: %v", discarded)
+	}
+}
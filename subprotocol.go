@@ -0,0 +1,15 @@
+package peregrine
+
+// negotiateSubprotocol reports whether the subprotocol requested by client is supported
+func (s *Server) negotiateSubprotocol(protocol []byte) bool {
+	_, ok := s.subprotocols[string(protocol)]
+	return ok
+}
+
+// handlerOf returns the handler of subprotocol, or the default handler if the subprotocol is not supported
+func (s *Server) handlerOf(protocol string) HandlerFunc {
+	if handler, ok := s.subprotocols[protocol]; ok {
+		return handler
+	}
+	return s.handler
+}
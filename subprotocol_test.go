@@ -0,0 +1,103 @@
+package peregrine
+
+import (
+	"bytes"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/panjf2000/gnet/v2"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServer_Subprotocols(t *testing.T) {
+	handled := make(chan string, 1)
+	route := func(name string) HandlerFunc {
+		return func(packet *Packet) {
+			handled <- name + ":" + packet.Conn.Subprotocol
+		}
+	}
+
+	s := NewServer(
+		"tcp://127.0.0.1:0",
+		WithHandler(route("default")),
+		WithSubprotocols(map[string]HandlerFunc{
+			"chat.v1": route("v1"),
+			"chat.v2": route("v2"),
+		}),
+	)
+
+	tests := []struct {
+		requested  string
+		negotiated string
+		expect     string
+	}{
+		{requested: "chat.v2, chat.v1", negotiated: "chat.v2", expect: "v2:chat.v2"},
+		{requested: "chat.v3, chat.v1", negotiated: "chat.v1", expect: "v1:chat.v1"},
+		{requested: "chat.v3", expect: "default:"},
+		{requested: "", expect: "default:"},
+	}
+	for _, tt := range tests {
+		c := &mockConn{}
+		handshake := testHandshake
+		if tt.requested != "" {
+			handshake = strings.TrimSuffix(handshake, "\r\n") + "Sec-WebSocket-Protocol: " + tt.requested + "\r\n\r\n"
+		}
+		c.inbound.WriteString(handshake)
+		if action := s.OnTraffic(c); action != gnet.None {
+			t.Fatalf("unexpected action: %v", action)
+		}
+
+		resp, _ := readHandshakeResponse(t, c)
+		if resp.Header.Get("Sec-WebSocket-Protocol") != tt.negotiated {
+			t.Fatalf("unexpected negotiated subprotocol: %s", resp.Header.Get("Sec-WebSocket-Protocol"))
+		}
+
+		buf := &bytes.Buffer{}
+		_ = wsutil.WriteClientText(buf, []byte("peregrine"))
+		c.inbound.Write(buf.Bytes())
+		if action := s.OnTraffic(c); action != gnet.None {
+			t.Fatalf("unexpected action: %v", action)
+		}
+
+		select {
+		case got := <-handled:
+			if got != tt.expect {
+				t.Fatalf("requested %q, expect handled by %s, got: %s", tt.requested, tt.expect, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("packet not handled")
+		}
+	}
+}
+
+func TestServer_RouteSubprotocol(t *testing.T) {
+	handled := make(chan string, 1)
+	s := NewServer(
+		"tcp://127.0.0.1:0",
+		WithSubprotocols(map[string]HandlerFunc{
+			"chat.v1": func(_ *Packet) { handled <- "subprotocol" },
+		}),
+	)
+	// the handler of route takes precedence over the subprotocol
+	s.Route("/", func(packet *Packet) { handled <- "route:" + packet.Conn.Subprotocol })
+
+	c := &mockConn{}
+	c.inbound.WriteString(strings.TrimSuffix(testHandshake, "\r\n") + "Sec-WebSocket-Protocol: chat.v1\r\n\r\n")
+	s.OnTraffic(c)
+	if resp, _ := readHandshakeResponse(t, c); resp.Header.Get("Sec-WebSocket-Protocol") != "chat.v1" {
+		t.Fatalf("unexpected negotiated subprotocol: %s", resp.Header.Get("Sec-WebSocket-Protocol"))
+	}
+
+	buf := &bytes.Buffer{}
+	_ = wsutil.WriteClientText(buf, []byte("peregrine"))
+	c.inbound.Write(buf.Bytes())
+	s.OnTraffic(c)
+	select {
+	case got := <-handled:
+		if got != "route:chat.v1" {
+			t.Fatalf("expect handled by route, got: %s", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("packet not handled")
+	}
+}
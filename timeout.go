@@ -0,0 +1,160 @@
+package peregrine
+
+import (
+	"github.com/gobwas/ws"
+	"github.com/panjf2000/gnet/v2"
+	"github.com/pkg/errors"
+	"time"
+)
+
+var (
+	ErrHandshakeTimeout  = errors.New("handshake timeout")
+	ErrIdleTimeout       = errors.New("idle timeout")
+	ErrWriteStallTimeout = errors.New("write stall timeout")
+)
+
+// timeouts of a conn, zero means disabled
+type timeouts struct {
+	// handshake from the conn opened until upgraded
+	handshake time.Duration
+	// idleRead from the last inbound traffic
+	idleRead time.Duration
+	// writeStall the outbound buffer not flushed
+	writeStall time.Duration
+
+	// pingInterval send ping to conn every interval, pongTimeout the deadline of pong
+	pingInterval time.Duration
+	pongTimeout  time.Duration
+}
+
+// stall the write progress of conn, only accessed by the event-loop
+type stall struct {
+	since   time.Time
+	flushed int64
+}
+
+func (t timeouts) enabled() bool {
+	return t.handshake > 0 || t.idleRead > 0 || t.writeStall > 0 || t.pingInterval > 0
+}
+
+// watch schedule the timeout check of conn
+func (s *Server) watch(conn *Conn) {
+	if !s.timeouts.enabled() {
+		return
+	}
+	conn.openedAt = s.wheel.now()
+	s.checkTimeout(conn)
+}
+
+// upgraded reschedule the timeout check of conn once it upgraded
+func (s *Server) upgraded(conn *Conn) {
+	if !s.timeouts.enabled() {
+		return
+	}
+	s.checkTimeout(conn)
+}
+
+// unwatch cancel the timeout check of conn, it's called once the conn closed
+func (s *Server) unwatch(conn *Conn) {
+	s.wheel.stop(&conn.timer)
+}
+
+// checkTimeout close conn if timed out, or schedule the next check.
+//
+// it's called by the wheel in OnTick, conn may be closed concurrently by the event-loop
+func (s *Server) checkTimeout(conn *Conn) {
+	if conn.released.Load() {
+		return
+	}
+
+	var (
+		now      = s.wheel.now()
+		deadline time.Time
+	)
+	expired := func(t time.Time) bool {
+		if !t.After(now) {
+			return true
+		}
+		if deadline.IsZero() || t.Before(deadline) {
+			deadline = t
+		}
+		return false
+	}
+
+	if !conn.readyUpgraded.Load() {
+		timeout := s.timeouts.handshake
+		if timeout == 0 {
+			timeout = s.timeouts.idleRead
+		}
+		if timeout > 0 && expired(conn.openedAt.Add(timeout)) {
+			conn.setCloseReason(ErrHandshakeTimeout)
+			_ = conn.Conn.Close()
+			return
+		}
+	} else {
+		if s.timeouts.idleRead > 0 && expired(time.Unix(0, conn.lastRead.Load()).Add(s.timeouts.idleRead)) {
+			if err := s.CloseConn(conn, ws.StatusGoingAway, ErrIdleTimeout); err != nil {
+				// the close handshake timed out
+				_ = conn.Conn.Close()
+			}
+			return
+		}
+
+		if s.timeouts.pingInterval > 0 {
+			next, ok := s.heartbeat(conn, now)
+			if !ok {
+				return
+			}
+			expired(next)
+		}
+	}
+
+	if s.timeouts.writeStall > 0 {
+		// the outbound buffer only can be accessed by the event-loop,
+		// probe it if the written bytes not flushed at the last probe
+		if written := conn.written.Load(); written != conn.probed.Load() {
+			_ = conn.Conn.AsyncWrite(nil, func(c gnet.Conn, err error) error {
+				if err == nil && s.stalled(conn, written, c.OutboundBuffered()) {
+					conn.setCloseReason(ErrWriteStallTimeout)
+					return c.Close()
+				}
+				return nil
+			})
+		}
+		expired(now.Add(s.timeouts.writeStall / 2))
+	}
+
+	if !deadline.IsZero() {
+		s.wheel.reset(&conn.timer, deadline, func() { s.checkTimeout(conn) })
+	}
+}
+
+// stalled reports whether the outbound buffer of conn not flushed during the write stall timeout,
+// it's called by the event-loop with the written bytes when the probe enqueued
+func (s *Server) stalled(conn *Conn, written int64, outbound int) bool {
+	var (
+		now     = s.wheel.now()
+		flushed = conn.written.Load() - int64(outbound)
+	)
+	if outbound == 0 {
+		// the bytes written before probe are flushed, no need to probe until next write
+		conn.probed.Store(written)
+	}
+	if outbound == 0 || flushed > conn.stall.flushed || conn.stall.since.IsZero() {
+		conn.stall = stall{since: now, flushed: flushed}
+		return false
+	}
+	return now.Sub(conn.stall.since) >= s.timeouts.writeStall
+}
+
+// StartTimeoutScanner the timeouts are checked by OnTick, it's a no-op
+//
+// Deprecated: the timeouts are started with the server
+func (s *Server) StartTimeoutScanner() {}
+
+// ConnTableLen returns the count of conns watched by the timeouts
+//
+// Deprecated: use CountConnections or Len
+func (s *Server) ConnTableLen() int {
+	return s.wheel.len()
+}
@@ -0,0 +1,195 @@
+package peregrine
+
+import (
+	"github.com/gobwas/ws"
+	"github.com/jellydator/ttlcache/v3"
+	"github.com/panjf2000/gnet/v2"
+	"math/rand"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// fakeClock the clock of wheel driven by tests
+type fakeClock struct {
+	s   *Server
+	now time.Time
+}
+
+// newFakeClock replace the clock of the wheel of s, it must be called before the conns opened
+func newFakeClock(s *Server) *fakeClock {
+	clock := &fakeClock{s: s, now: s.wheel.start}
+	s.wheel.now = func() time.Time { return clock.now }
+	return clock
+}
+
+// advance the clock by d and tick the server
+func (c *fakeClock) advance(d time.Duration) {
+	c.now = c.now.Add(d)
+	c.s.OnTick()
+}
+
+// tickUntil advance the clock tick by tick until conn closed or d elapsed
+func (c *fakeClock) tickUntil(conn *mockConn, d time.Duration) {
+	for end := c.now.Add(d); !conn.closed && c.now.Before(end); {
+		c.advance(c.s.wheel.tick)
+	}
+}
+
+func TestServer_HandshakeTimeout(t *testing.T) {
+	s := NewServer("tcp://127.0.0.1:0", WithHandshakeTimeout(30*time.Millisecond), WithTimeoutTick(5*time.Millisecond))
+	clock := newFakeClock(s)
+
+	c := &mockConn{}
+	s.OnOpen(c)
+	c.inbound.WriteString("GET / HTTP/1.1\r\n")
+	s.OnTraffic(c)
+
+	clock.advance(25 * time.Millisecond)
+	if c.closed {
+		t.Fatal("conn closed before handshake timeout")
+	}
+	clock.advance(10 * time.Millisecond)
+	if err := c.Context().(*Conn).closeReason(nil); !c.closed || err != ErrHandshakeTimeout {
+		t.Fatalf("expect closed by %v, got: %v", ErrHandshakeTimeout, err)
+	}
+}
+
+func TestServer_IdleTimeout(t *testing.T) {
+	s := NewServer("tcp://127.0.0.1:0", WithIdleTimeout(50*time.Millisecond), WithTimeoutTick(5*time.Millisecond))
+	clock := newFakeClock(s)
+
+	c := &mockConn{}
+	s.OnOpen(c)
+	c.inbound.WriteString(testHandshake)
+	s.OnTraffic(c)
+	_, r := readHandshakeResponse(t, c)
+
+	// the traffic delays the timeout
+	for i := 0; i < 4; i++ {
+		clock.advance(40 * time.Millisecond)
+		c.inbound.Write(compileClientFrame(t, ws.NewBinaryFrame([]byte("peregrine"))))
+		if action := s.OnTraffic(c); action != gnet.None || c.closed {
+			t.Fatal("conn closed before idle timeout")
+		}
+	}
+
+	clock.advance(45 * time.Millisecond)
+	if c.closed {
+		t.Fatal("conn closed before idle timeout")
+	}
+	clock.advance(10 * time.Millisecond)
+	if !c.closed {
+		t.Fatal("conn not closed")
+	}
+	frame, err := ws.ReadFrame(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code, reason := ws.ParseCloseFrameData(frame.Payload); code != ws.StatusGoingAway || reason != ErrIdleTimeout.Error() {
+		t.Fatalf("unexpected close frame: %d, %s", code, reason)
+	}
+}
+
+func TestServer_WriteStallTimeout(t *testing.T) {
+	s := NewServer(
+		"tcp://127.0.0.1:0",
+		WithIdleTimeout(0),
+		WithWriteStallTimeout(30*time.Millisecond),
+		WithTimeoutTick(5*time.Millisecond),
+	)
+	clock := newFakeClock(s)
+
+	c := &mockConn{}
+	s.OnOpen(c)
+	c.inbound.WriteString(testHandshake)
+	s.OnTraffic(c)
+	conn := c.Context().(*Conn)
+
+	// flushed
+	_ = conn.WriteText([]byte("peregrine"))
+	clock.tickUntil(c, 100*time.Millisecond)
+	if c.closed {
+		t.Fatal("conn closed without stall")
+	}
+
+	// the peer stops reading
+	c.buffered = 1024
+	_ = conn.WriteText([]byte("peregrine"))
+	clock.tickUntil(c, 100*time.Millisecond)
+	if err := conn.closeReason(nil); !c.closed || err != ErrWriteStallTimeout {
+		t.Fatalf("expect closed by %v, got: %v", ErrWriteStallTimeout, err)
+	}
+}
+
+const benchmarkConns = 100000
+
+// BenchmarkTimeout_Traffic compare the cost of keeping a conn alive on every OnTraffic
+func BenchmarkTimeout_Traffic(b *testing.B) {
+	b.Run("ttlcache", func(b *testing.B) {
+		cache := ttlcache.New[string, gnet.Conn](ttlcache.WithTTL[string, gnet.Conn](15 * time.Second))
+		keys := make([]string, benchmarkConns)
+		for i := range keys {
+			keys[i] = (&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: i}).String()
+			cache.Set(keys[i], nil, ttlcache.DefaultTTL)
+		}
+
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			r := rand.New(rand.NewSource(time.Now().UnixNano()))
+			for pb.Next() {
+				// RemoteAddr().String() is called on every OnTraffic
+				cache.Touch((&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: r.Intn(benchmarkConns)}).String())
+			}
+		})
+	})
+
+	b.Run("timingwheel", func(b *testing.B) {
+		s := NewServer("tcp://127.0.0.1:0")
+		conns := make([]*Conn, benchmarkConns)
+		for i := range conns {
+			conns[i] = NewUpgraderConn(&mockConn{})
+			s.watch(conns[i])
+		}
+
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			r := rand.New(rand.NewSource(time.Now().UnixNano()))
+			for pb.Next() {
+				conns[r.Intn(benchmarkConns)].keepAlive(time.Now())
+			}
+		})
+	})
+}
+
+// BenchmarkTimeout_OpenClose compare the cost of watching and unwatching a conn
+func BenchmarkTimeout_OpenClose(b *testing.B) {
+	b.Run("ttlcache", func(b *testing.B) {
+		cache := ttlcache.New[string, gnet.Conn](ttlcache.WithTTL[string, gnet.Conn](15 * time.Second))
+		for i := 0; i < benchmarkConns; i++ {
+			cache.Set("conn-"+strconv.Itoa(i), nil, ttlcache.DefaultTTL)
+		}
+
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			key := (&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: i}).String()
+			cache.Set(key, nil, ttlcache.DefaultTTL)
+			cache.Delete(key)
+		}
+	})
+
+	b.Run("timingwheel", func(b *testing.B) {
+		s := NewServer("tcp://127.0.0.1:0")
+		for i := 0; i < benchmarkConns; i++ {
+			s.watch(NewUpgraderConn(&mockConn{}))
+		}
+
+		conn := NewUpgraderConn(&mockConn{})
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			s.watch(conn)
+			s.unwatch(conn)
+		}
+	})
+}
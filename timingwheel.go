@@ -0,0 +1,190 @@
+package peregrine
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	wheelBits   = 6
+	wheelSize   = 1 << wheelBits
+	wheelMask   = wheelSize - 1
+	wheelLevels = 4
+
+	// wheelMaxTicks the longest delay of timer, 64^4 ticks
+	wheelMaxTicks = 1<<(wheelBits*wheelLevels) - 1
+)
+
+// timer is a task scheduled in the timingWheel, it's reused by resetting
+type timer struct {
+	expire int64
+	task   func()
+
+	// bucket nil if the timer is not scheduled
+	bucket     *bucket
+	prev, next *timer
+}
+
+type bucket struct {
+	head *timer
+}
+
+func (b *bucket) push(t *timer) {
+	t.bucket = b
+	t.prev = nil
+	t.next = b.head
+	if b.head != nil {
+		b.head.prev = t
+	}
+	b.head = t
+}
+
+func (b *bucket) remove(t *timer) {
+	if t.prev != nil {
+		t.prev.next = t.next
+	} else {
+		b.head = t.next
+	}
+	if t.next != nil {
+		t.next.prev = t.prev
+	}
+	t.bucket, t.prev, t.next = nil, nil, nil
+}
+
+// flush detach all timers of bucket, returns them as a list linked by next
+func (b *bucket) flush() *timer {
+	head := b.head
+	b.head = nil
+	for t := head; t != nil; t = t.next {
+		t.bucket, t.prev = nil, nil
+	}
+	return head
+}
+
+// timingWheel is a hierarchical timing wheel, 4 levels of 64 slots.
+//
+// the timers are scheduled and canceled in O(1), the wheel is advanced by the caller (OnTick)
+type timingWheel struct {
+	mu sync.Mutex
+
+	// now the clock of wheel, the deadlines of timeouts are measured by it
+	now     func() time.Time
+	start   time.Time
+	tick    time.Duration
+	current int64
+	count   int
+
+	levels [wheelLevels][wheelSize]bucket
+
+	// expired only accessed by advance
+	expired []func()
+}
+
+func newTimingWheel(tick time.Duration) *timingWheel {
+	return &timingWheel{
+		now:   time.Now,
+		start: time.Now(),
+		tick:  tick,
+	}
+}
+
+// ticks returns the tick of t since the wheel started, rounded up
+func (w *timingWheel) ticks(t time.Time) int64 {
+	d := t.Sub(w.start)
+	return int64((d + w.tick - 1) / w.tick)
+}
+
+// reset schedule t to call task at deadline, the timer is rescheduled if it's already scheduled
+func (w *timingWheel) reset(t *timer, deadline time.Time, task func()) {
+	w.mu.Lock()
+	if t.bucket != nil {
+		t.bucket.remove(t)
+		w.count--
+	}
+	t.task = task
+
+	expire := w.ticks(deadline)
+	if expire <= w.current {
+		// the slot of current tick has been expired
+		expire = w.current + 1
+	}
+	t.expire = expire
+	w.add(t)
+	w.mu.Unlock()
+}
+
+// stop cancel the timer, returns false if the timer is not scheduled
+func (w *timingWheel) stop(t *timer) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if t.bucket == nil {
+		return false
+	}
+	t.bucket.remove(t)
+	w.count--
+	return true
+}
+
+// len returns the count of scheduled timers
+func (w *timingWheel) len() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.count
+}
+
+// add put the timer into the slot of its level, t.expire must not be less than current
+func (w *timingWheel) add(t *timer) {
+	delta := t.expire - w.current
+	if delta > wheelMaxTicks {
+		delta = wheelMaxTicks
+		t.expire = w.current + delta
+	}
+
+	level := 0
+	for delta >= 1<<(wheelBits*(level+1)) {
+		level++
+	}
+	w.levels[level][(t.expire>>(wheelBits*level))&wheelMask].push(t)
+	w.count++
+}
+
+// advance the wheel to now, the tasks of expired timers are called in order of ticks.
+// advance must not be called concurrently
+func (w *timingWheel) advance(now time.Time) {
+	target := w.ticks(now)
+	for {
+		w.mu.Lock()
+		if w.current >= target {
+			w.mu.Unlock()
+			return
+		}
+		w.current++
+
+		// cascade the timers of upper level into lower levels once the lower level wrapped
+		for level := 1; level < wheelLevels && w.current&(1<<(wheelBits*level)-1) == 0; level++ {
+			index := (w.current >> (wheelBits * level)) & wheelMask
+			for t := w.levels[level][index].flush(); t != nil; {
+				next := t.next
+				w.count--
+				w.add(t)
+				t = next
+			}
+		}
+
+		// the tasks are called without lock, the timers may be rescheduled by tasks or other goroutines
+		w.expired = w.expired[:0]
+		for t := w.levels[0][w.current&wheelMask].flush(); t != nil; {
+			next := t.next
+			t.next = nil
+			w.expired = append(w.expired, t.task)
+			w.count--
+			t = next
+		}
+		w.mu.Unlock()
+
+		for i, task := range w.expired {
+			task()
+			w.expired[i] = nil
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package peregrine
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimingWheel(t *testing.T) {
+	var (
+		w     = newTimingWheel(time.Millisecond)
+		fired = make(map[int]int64)
+		ticks = []int{1, 2, 63, 64, 65, 4095, 4096, 4097, 300000}
+	)
+
+	timers := make([]timer, len(ticks))
+	for i, tick := range ticks {
+		tick := tick
+		w.reset(&timers[i], w.start.Add(time.Duration(tick)*w.tick), func() {
+			fired[tick] = w.current
+		})
+	}
+	if w.len() != len(ticks) {
+		t.Fatalf("expect %d timers, got: %d", len(ticks), w.len())
+	}
+
+	for _, tick := range ticks {
+		w.advance(w.start.Add(time.Duration(tick-1) * w.tick))
+		if _, ok := fired[tick]; ok {
+			t.Fatalf("timer of tick %d fired early", tick)
+		}
+		w.advance(w.start.Add(time.Duration(tick) * w.tick))
+		if fired[tick] != int64(tick) {
+			t.Fatalf("timer of tick %d fired at: %d", tick, fired[tick])
+		}
+	}
+	if w.len() != 0 {
+		t.Fatalf("expect no timers, got: %d", w.len())
+	}
+}
+
+func TestTimingWheel_Stop(t *testing.T) {
+	var (
+		w     = newTimingWheel(time.Millisecond)
+		tm    timer
+		fired int
+	)
+
+	w.reset(&tm, w.start.Add(10*w.tick), func() { fired++ })
+	// rescheduled
+	w.reset(&tm, w.start.Add(100*w.tick), func() { fired++ })
+	w.advance(w.start.Add(50 * w.tick))
+	if fired != 0 {
+		t.Fatal("rescheduled timer fired at the old deadline")
+	}
+
+	if !w.stop(&tm) || w.stop(&tm) {
+		t.Fatal("unexpected stop result")
+	}
+	w.advance(w.start.Add(200 * w.tick))
+	if fired != 0 {
+		t.Fatal("stopped timer fired")
+	}
+}